@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// CheckpointStatus binlog 位置
+type CheckpointStatus struct {
+	// 所有规则都已处理完成的位置，重启之后从这里继续
+	Checkpoint MySqlPosition `json:"checkpoint"`
+	// canal 已同步的位置
+	Synced MySqlPosition `json:"synced"`
+	// 延迟的秒数
+	DelaySeconds uint32 `json:"delaySeconds"`
+}
+
+// RegisterAdminHandlers 注册管理接口，未配置 token 不开启
+func RegisterAdminHandlers(mux *http.ServeMux) {
+	token := Config.Admin.Token
+	if len(token) == 0 {
+		slog.Warn("admin api disabled, admin.token is empty")
+		return
+	}
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, adminAuth(token, handler))
+	}
+	handle("GET /admin/rules", listRules)
+	handle("GET /admin/rules/{name}", getRule)
+	handle("POST /admin/rules/{name}/pause", pauseRule)
+	handle("POST /admin/rules/{name}/resume", resumeRule)
+	handle("POST /admin/rules/{name}/snapshot", snapshotRule)
+	handle("GET /admin/checkpoint", getCheckpoint)
+	handle("PUT /admin/checkpoint", setCheckpoint)
+}
+
+// adminAuth 校验 Authorization: Bearer <token>
+func adminAuth(token string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+func listRules(w http.ResponseWriter, r *http.Request) {
+	rules := ActiveRules()
+	list := make([]RuleStatus, 0, len(rules))
+	for _, rule := range rules {
+		list = append(list, rule.Status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getRule(w http.ResponseWriter, r *http.Request) {
+	rule := FindEventRule(r.PathValue("name"))
+	if rule == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rule %s not found", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, http.StatusOK, rule.Status())
+}
+
+func pauseRule(w http.ResponseWriter, r *http.Request) {
+	rule := FindEventRule(r.PathValue("name"))
+	if rule == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rule %s not found", r.PathValue("name")))
+		return
+	}
+	rule.Pause()
+	writeJSON(w, http.StatusOK, rule.Status())
+}
+
+func resumeRule(w http.ResponseWriter, r *http.Request) {
+	rule := FindEventRule(r.PathValue("name"))
+	if rule == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rule %s not found", r.PathValue("name")))
+		return
+	}
+	rule.Resume()
+	writeJSON(w, http.StatusOK, rule.Status())
+}
+
+// snapshotRule 重新初始化规则的数据，?table=库名.表名 只初始化一张表
+func snapshotRule(w http.ResponseWriter, r *http.Request) {
+	rule := FindEventRule(r.PathValue("name"))
+	if rule == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rule %s not found", r.PathValue("name")))
+		return
+	}
+	if err := Resnapshot(rule, r.URL.Query().Get("table")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, rule.Status())
+}
+
+func getCheckpoint(w http.ResponseWriter, r *http.Request) {
+	checkpoint := Checkpoint()
+	status := CheckpointStatus{
+		Checkpoint: MySqlPosition{File: checkpoint.Name, Position: checkpoint.Pos},
+	}
+	if c := CurrentCanal(); c != nil {
+		synced := c.SyncedPosition()
+		status.Synced = MySqlPosition{File: synced.Name, Position: synced.Pos}
+		status.DelaySeconds = c.GetDelay()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// setCheckpoint 从新的 binlog 位置重新开始同步
+func setCheckpoint(w http.ResponseWriter, r *http.Request) {
+	var mp MySqlPosition
+	if err := json.NewDecoder(r.Body).Decode(&mp); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(mp.File) == 0 || mp.Position < 4 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid position %s:%d", mp.File, mp.Position))
+		return
+	}
+	if err := RestartCanal(gomysql.Position{Name: mp.File, Pos: mp.Position}); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CheckpointStatus{Checkpoint: mp})
+}
+
+// Resnapshot 重新初始化规则的数据
+func Resnapshot(rule *EventRule, table string) error {
+	if snapshotDB == nil {
+		return fmt.Errorf("mysql not connected")
+	}
+	tableNames, err := QueryTableNames(snapshotDB)
+	if err != nil {
+		return err
+	}
+	if len(table) > 0 {
+		if !slices.Contains(tableNames, table) || !rule.Reg.MatchString(table) {
+			// 表已经删除或者不属于规则，重试也不会成功
+			return Permanent(fmt.Errorf("table %s does not match rule %s", table, rule.Name))
+		}
+		tableNames = []string{table}
+	}
+	if rule.snapshotting.Load() {
+		return fmt.Errorf("rule %s is snapshotting", rule.Name)
+	}
+	// 从头开始，不继续之前的进度
+	ClearSnapshotProgress(rule.Name, tableNames)
+	return rule.StartSnapshot(snapshotDB, tableNames, nil)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin encode", slog.Any("err", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
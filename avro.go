@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AvroFormat avro 序列化，使用 Confluent 的格式: 0 + 4 字节的结构编号 + avro 二进制
+const AvroFormat = "avro"
+
+var avroDecimalType = regexp.MustCompile(`^decimal\((\d+)(?:,(\d+))?\)`)
+
+// AvroSchema 规则的 avro 结构，每张表一个 record，字段都可以为 null。
+// 表结构变化之后生成新的结构注册到 schema registry，新增的字段默认值是 null，可以向后兼容
+type AvroSchema struct {
+	RuleName string
+
+	// 同步的字段
+	Projection
+
+	// 合并的查询字段
+	Enrich []EnrichRule
+
+	Registry SchemaRegistry
+
+	mu      sync.Mutex
+	records map[string]*avroRecord
+}
+
+type avroRecord struct {
+	// 生成结构的表结构
+	table *schema.Table
+	// schema registry 中的编号
+	id     int
+	fields []schemaField
+	types  []avroType
+}
+
+// avroType 字段的类型，decimal 是 bytes 的逻辑类型
+type avroType struct {
+	Type        string
+	LogicalType string
+	Precision   int
+	Scale       int32
+}
+
+// Marshal 序列化投影之后的行
+func (s *AvroSchema) Marshal(table *schema.Table, row map[string]interface{}) ([]byte, error) {
+	tableName := table.Schema + "." + table.Name
+	record, err := s.record(table)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 5, 64)
+	binary.BigEndian.PutUint32(buf[1:], uint32(record.id))
+	for i, field := range record.fields {
+		value := row[field.Key]
+		if value == nil {
+			// union 的第一个类型 null
+			buf = binary.AppendVarint(buf, 0)
+			continue
+		}
+		buf = binary.AppendVarint(buf, 1)
+		if buf, err = avroAppend(buf, record.types[i], value); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", tableName, field.Key, err)
+		}
+	}
+	return buf, nil
+}
+
+// Invalidate 表结构变化之后重新生成结构
+func (s *AvroSchema) Invalidate(tableName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, tableName)
+}
+
+// record 表的结构，事件的表结构和生成结构的不同时重新生成
+func (s *AvroSchema) record(table *schema.Table) (*avroRecord, error) {
+	tableName := table.Schema + "." + table.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[tableName]; ok && sameEncodedColumns(record.table, table) {
+		return record, nil
+	}
+	record, err := s.newRecord(table)
+	if err != nil {
+		return nil, err
+	}
+	if s.records == nil {
+		s.records = map[string]*avroRecord{}
+	}
+	s.records[tableName] = record
+	return record, nil
+}
+
+func (s *AvroSchema) newRecord(table *schema.Table) (*avroRecord, error) {
+	record := &avroRecord{table: table, fields: schemaFields(s.Projection, s.Enrich, table)}
+	fields := make([]map[string]interface{}, len(record.fields))
+	for i, field := range record.fields {
+		fieldType := avroFieldType(field)
+		record.types = append(record.types, fieldType)
+		fields[i] = map[string]interface{}{
+			"name":    safeFieldName(field.Key),
+			"type":    []interface{}{"null", fieldType.schema()},
+			"default": nil,
+		}
+	}
+	namespace := strings.ToLower(safeFieldName(s.RuleName)) + "." + safeFieldName(table.Schema)
+	name := safeTypeName(table.Name)
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      name,
+		"namespace": "canal." + namespace,
+		"fields":    fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 和 Confluent 的 TopicRecordNameStrategy 相同: <规则名称>-<record 全名>
+	subject := fmt.Sprintf("%s-canal.%s.%s", s.RuleName, namespace, name)
+	if record.id, err = s.Registry.Register(subject, string(data)); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (t avroType) schema() interface{} {
+	if len(t.LogicalType) == 0 {
+		return t.Type
+	}
+	result := map[string]interface{}{"type": t.Type, "logicalType": t.LogicalType}
+	if t.LogicalType == "decimal" {
+		result["precision"] = t.Precision
+		result["scale"] = t.Scale
+	}
+	return result
+}
+
+// avroFieldType mysql 字段类型对应的 avro 类型
+func avroFieldType(field schemaField) avroType {
+	column := field.Column
+	if column == nil {
+		return avroType{Type: "string"}
+	}
+	switch column.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT, schema.TYPE_BIT:
+		// 无符号的 BIGINT 超过 long 的范围
+		if column.IsUnsigned && strings.HasPrefix(column.RawType, "bigint") {
+			return avroType{Type: "bytes", LogicalType: "decimal", Precision: 20}
+		}
+		return avroType{Type: "long"}
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(column.RawType, "float") {
+			return avroType{Type: "float"}
+		}
+		return avroType{Type: "double"}
+	case schema.TYPE_DECIMAL:
+		t := avroType{Type: "bytes", LogicalType: "decimal", Precision: 10}
+		if m := avroDecimalType.FindStringSubmatch(column.RawType); m != nil {
+			t.Precision, _ = strconv.Atoi(m[1])
+			scale, _ := strconv.Atoi(m[2])
+			t.Scale = int32(scale)
+		}
+		return t
+	case schema.TYPE_DATE, schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_TIME:
+		// 按配置的格式输出，epochMillis 是整数
+		if (TemporalValue{Type: column.Type}).Layout() != TemporalEpochMillis {
+			return avroType{Type: "string"}
+		}
+		if column.Type == schema.TYPE_DATETIME || column.Type == schema.TYPE_TIMESTAMP {
+			return avroType{Type: "long", LogicalType: "timestamp-millis"}
+		}
+		return avroType{Type: "long"}
+	case schema.TYPE_BINARY:
+		return avroType{Type: "bytes"}
+	case schema.TYPE_STRING:
+		if isBinaryColumn(column) {
+			return avroType{Type: "bytes"}
+		}
+	}
+	// JSON 是 json 字符串，ENUM、SET 是名称
+	return avroType{Type: "string"}
+}
+
+// avroAppend 按 avro 的二进制格式写入值
+func avroAppend(buf []byte, t avroType, value interface{}) ([]byte, error) {
+	if v, ok := value.(TemporalValue); ok {
+		value = v.Format()
+	}
+	switch {
+	case t.LogicalType == "decimal":
+		d, err := decimal.NewFromString(ConvertAnyToString(value))
+		if err != nil {
+			return nil, err
+		}
+		b := twosComplement(d.Shift(t.Scale).Round(0).BigInt())
+		buf = binary.AppendVarint(buf, int64(len(b)))
+		return append(buf, b...), nil
+	case t.Type == "long":
+		if n, err := strconv.ParseInt(ConvertAnyToString(value), 10, 64); err == nil {
+			return binary.AppendVarint(buf, n), nil
+		}
+		if f, ok := filterNumber(value); ok {
+			return binary.AppendVarint(buf, int64(f)), nil
+		}
+		return nil, fmt.Errorf("cannot convert %T to long", value)
+	case t.Type == "float" || t.Type == "double":
+		f, ok := filterNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %T to %s", value, t.Type)
+		}
+		if t.Type == "float" {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case t.Type == "bytes":
+		b, ok := value.([]byte)
+		if !ok {
+			b = []byte(ConvertAnyToString(value))
+		}
+		buf = binary.AppendVarint(buf, int64(len(b)))
+		return append(buf, b...), nil
+	}
+	var s string
+	switch v := value.(type) {
+	case decimal.Decimal:
+		s = v.String()
+	case json.Number:
+		s = v.String()
+	default:
+		s = ConvertAnyToString(value)
+	}
+	buf = binary.AppendVarint(buf, int64(len(s)))
+	return append(buf, s...), nil
+}
+
+// twosComplement 大端的补码，avro 的 decimal 使用这个格式
+func twosComplement(n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	// 负数: 2^(8*size) + n
+	size := new(big.Int).Not(n).BitLen()/8 + 1
+	m := new(big.Int).Lsh(big.NewInt(1), uint(size*8))
+	return m.Add(m, n).Bytes()
+}
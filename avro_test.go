@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+func TestAvroSchema(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "t_order"}
+	table.AddColumn("id", "bigint(20)", "", "")
+	table.AddColumn("amount", "decimal(10,2)", "", "")
+	table.AddColumn("remark", "varchar(64)", "utf8mb4_general_ci", "")
+	registry := &FileRegistry{Path: filepath.Join(t.TempDir(), "schema_registry.json")}
+	s := &AvroSchema{RuleName: "order", Registry: registry}
+	record, err := s.newRecord(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.records = map[string]*avroRecord{"test.t_order": record}
+	data, err := s.Marshal(table, map[string]interface{}{
+		"id":     int64(1),
+		"amount": decimal.RequireFromString("12.50"),
+		"remark": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 0, 1, 2, 2, 2, 4, 0x04, 0xe2, 0}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+
+	// 相同的结构返回相同的编号，新增字段之后注册新的版本
+	if again, _ := s.newRecord(table); again.id != 1 {
+		t.Errorf("same schema id %d", again.id)
+	}
+	table.AddColumn("status", "tinyint(4)", "", "")
+	if evolved, _ := s.newRecord(table); evolved.id != 2 {
+		t.Errorf("evolved schema id %d", evolved.id)
+	}
+	if versions := registry.data.Subjects["order-canal.order.test.TOrder"]; len(versions) != 2 {
+		t.Errorf("versions %v", versions)
+	}
+
+	// DDL 之前的事件按事件的表结构，使用原来的结构编号
+	older := &schema.Table{Schema: "test", Name: "t_order"}
+	older.AddColumn("id", "bigint(20)", "", "")
+	older.AddColumn("amount", "decimal(10,2)", "", "")
+	older.AddColumn("remark", "varchar(64)", "utf8mb4_general_ci", "")
+	if _, err = s.Marshal(older, map[string]interface{}{"id": int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if record := s.records["test.t_order"]; record.table != older || record.id != 1 {
+		t.Errorf("record not rebuilt for the event schema, id %d", record.id)
+	}
+
+	// 以数字开头的表名，record 名称加上前缀
+	if _, err = s.newRecord(&schema.Table{Schema: "test", Name: "2024_log"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.data.Subjects["order-canal.order.test._2024Log"]; !ok {
+		t.Errorf("subjects %v", registry.data.Subjects)
+	}
+}
+
+func TestTwosComplement(t *testing.T) {
+	for n, want := range map[int64][]byte{0: {0}, 127: {0x7f}, 128: {0, 0x80}, -1: {0xff}, -128: {0x80}, -129: {0xff, 0x7f}} {
+		if got := twosComplement(big.NewInt(n)); !bytes.Equal(got, want) {
+			t.Errorf("%d: got %x, want %x", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/samber/lo"
+	"strings"
+	"time"
+)
+
+// EnvelopeCloudEvents 按 CloudEvents 1.0 包装事件
+const EnvelopeCloudEvents = "cloudevents"
+
+const (
+	// CloudEventsStructured 属性和数据写在同一个消息中
+	CloudEventsStructured = "structured"
+	// CloudEventsBinary 属性写在 ce- 开头的消息头中，消息体只有数据
+	CloudEventsBinary = "binary"
+)
+
+// CloudEvent 包装成 CloudEvents 1.0 的事件，data 是修改之后的行，删除事件是删除之前的行。
+// type: <schema>.<table>.<action>，source: mysql://<地址>/<schema>，id: <binlog 文件>:<位置>:<主键>，subject: 主键
+func CloudEvent(format string, data *EventData, projection Projection) map[string]interface{} {
+	src := data.Source
+	if src == nil {
+		src = &EventSource{}
+	}
+	db, table, _ := strings.Cut(data.TableName, ".")
+	row := data.After
+	if data.Action == canal.DeleteAction {
+		row = data.Before
+	}
+	subject := strings.Join(lo.Map(data.PKColumns, func(item string, index int) string {
+		return ConvertAnyToString(row[item])
+	}), ",")
+	id := fmt.Sprintf("%s:%d:%s", src.File, src.Pos, subject)
+	if src.Snapshot {
+		id = "snapshot:" + id
+	}
+	ts := time.Now()
+	if src.TsMs > 0 {
+		ts = time.UnixMilli(src.TsMs)
+	}
+	event := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              id,
+		"source":          fmt.Sprintf("mysql://%s/%s", Config.Mysql.Addr, db),
+		"type":            fmt.Sprintf("%s.%s.%s", db, table, data.Action),
+		"time":            ts.UTC().Format(time.RFC3339Nano),
+		"datacontenttype": cloudEventsContentType(format),
+		"data":            projection.Project(row),
+	}
+	if len(subject) > 0 {
+		event["subject"] = subject
+	}
+	return event
+}
+
+// CloudEventHeaders binary 模式的消息头，和 HTTP 绑定相同: ce-<属性>，datacontenttype 是 Content-Type
+func CloudEventHeaders(event map[string]interface{}) map[string]string {
+	headers := map[string]string{}
+	for key, value := range event {
+		switch key {
+		case "data":
+		case "datacontenttype":
+			headers["Content-Type"] = ConvertAnyToString(value)
+		default:
+			headers["ce-"+key] = ConvertAnyToString(value)
+		}
+	}
+	return headers
+}
+
+// cloudEventsContentType 序列化格式对应的 datacontenttype
+func cloudEventsContentType(format string) string {
+	switch format {
+	case "msgpack":
+		return "application/msgpack"
+	case "yaml":
+		return "application/yaml"
+	case "protobuf":
+		return "application/protobuf"
+	}
+	return "application/json"
+}
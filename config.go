@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/spf13/viper"
 	"log/slog"
+	"time"
 )
 
 // Config 全局配置配置文件
@@ -20,6 +21,21 @@ func init() {
 			ServerId: 88,
 		},
 	)
+	viper.SetDefault("http.addr", "127.0.0.1:8090")
+	viper.SetDefault("health.maxLagSeconds", 60)
+	viper.SetDefault("dataDir", "./data")
+	viper.SetDefault("spool.segmentSizeMB", 64)
+	viper.SetDefault("spool.maxSizeMB", 1024)
+	viper.SetDefault("spool.retryInterval", "3s")
+	viper.SetDefault("script.timeout", "100ms")
+	viper.SetDefault("snapshot.workers", 1)
+	viper.SetDefault("snapshot.chunksPerTable", 1)
+	viper.SetDefault("temporal.sourceTimezone", "Local")
+	viper.SetDefault("temporal.outputTimezone", "Local")
+	viper.SetDefault("temporal.dateFormat", time.DateOnly)
+	viper.SetDefault("temporal.datetimeFormat", time.DateTime)
+	viper.SetDefault("temporal.timestampFormat", time.DateTime)
+	viper.SetDefault("temporal.timeFormat", time.TimeOnly)
 	viper.SetDefault(
 		"rules",
 		map[string]SyncRule{
@@ -61,6 +77,36 @@ type AppConfig struct {
 	// elasticsearch 的配置
 	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch" json:"elasticsearch"`
 
+	// http 服务的配置
+	Http HttpConfig `yaml:"http" json:"http"`
+
+	// 健康检查的配置
+	Health HealthConfig `yaml:"health" json:"health"`
+
+	// 管理接口的配置
+	Admin AdminConfig `yaml:"admin" json:"admin"`
+
+	// 数据目录，保存磁盘缓冲队列、binlog 位置等。默认: ./data
+	DataDir string `yaml:"dataDir" json:"dataDir"`
+
+	// 磁盘缓冲队列的配置
+	Spool SpoolConfig `yaml:"spool" json:"spool"`
+
+	// 规则脚本的配置
+	Script ScriptConfig `yaml:"script" json:"script"`
+
+	// 初始化数据的配置
+	Snapshot SnapshotConfig `yaml:"snapshot" json:"snapshot"`
+
+	// 日期、时间字段的时区和格式
+	Temporal TemporalConfig `yaml:"temporal" json:"temporal"`
+
+	// avro 的 schema registry
+	SchemaRegistry SchemaRegistryConfig `yaml:"schemaRegistry" json:"schemaRegistry"`
+
+	// 监听配置文件，热加载同步的规则。开启之后 binlog 不再按 tableRegex 过滤表
+	ReloadRules bool `yaml:"reloadRules" json:"reloadRules"`
+
 	// 同步的规则
 	Rules map[string]SyncRule `yaml:"rules" json:"rules"`
 }
@@ -73,12 +119,24 @@ type MysqlConfig struct {
 	Password string `yaml:"password" json:"password" `
 
 	ServerId uint32 `yaml:"serverId" json:"serverId" `
+
+	// 初始化数据读取的从库地址，为空时读取主库。需要开启 GTID
+	SnapshotAddr string `yaml:"snapshotAddr" json:"snapshotAddr"`
+
+	// 从库的用户名，为空时使用 username
+	SnapshotUsername string `yaml:"snapshotUsername" json:"snapshotUsername"`
+
+	// 从库的密码，为空时使用 password
+	SnapshotPassword string `yaml:"snapshotPassword" json:"snapshotPassword"`
 }
 
 type SyncRule struct {
 	// 表用作ID 的名称
 	TableRegex string `yaml:"tableRegex" json:"tableRegex"`
 
+	// 行过滤表达式，SQL WHERE 的子集，例如: status = 1 AND tenant_id IN (3,5)。为空不过滤
+	Where string `yaml:"where" json:"where"`
+
 	// 同步的目的地 redis、console、es7、es8
 	SyncTarget string `yaml:"syncTarget" json:"syncTarget"`
 
@@ -91,31 +149,70 @@ type SyncRule struct {
 	// 自定义主键
 	CustomPKColumn string `yaml:"customPKColumn" json:"customPKColumn"`
 
-	// 序列化格式，支持: msgpack、json、yaml、protobuf
+	// 序列化格式，支持: msgpack、json、yaml、protobuf、typedProtobuf、avro
 	SerializationFormat string `yaml:"serializationFormat" json:"serializationFormat"`
 
+	// 事件的包装格式: debezium、canal、maxwell、cloudevents，为空只写入 after
+	Envelope string `yaml:"envelope" json:"envelope"`
+
+	// CloudEvents 的模式: structured、binary，默认 structured
+	CloudEventsMode string `yaml:"cloudEventsMode" json:"cloudEventsMode"`
+
+	// 写入事件来源的字段名称: {file, pos, gtid, server_id, ts_ms, tx_id, snapshot}，为空不写入
+	SourceField string `yaml:"sourceField" json:"sourceField"`
+
 	// 包含的 表格 行 名称。为空，全部行
 	IncludeColumnNames []string `yaml:"includeColumnNames" json:"includeColumnNames"`
 
 	// 排除的 表格 行 名称。为空，全部行
 	ExcludeColumnNames []string `yaml:"excludeColumnNames" json:"excludeColumnNames"`
 
+	// 字段重命名，例如 device_sn: sn。重命名之后不再按 fieldNameFormat 转换
+	ColumnRename map[string]string `yaml:"columnRename" json:"columnRename"`
+
+	// 计算字段，名称 = 表达式，例如: full_name = concat(first_name, ' ', last_name)
+	ComputedFields []string `yaml:"computedFields" json:"computedFields"`
+
+	// 按字段查询其他表，查询到的字段合并到 After
+	Enrich []EnrichRule `yaml:"enrich" json:"enrich"`
+
+	// 表结构变化的处理策略
+	DDL DDLPolicy `yaml:"ddl" json:"ddl"`
+
+	// lua 脚本的路径，定义 function transform(event)，在写入 sink 之前修改、丢弃、拆分事件
+	Script string `yaml:"script" json:"script"`
+
+	// 字段脱敏，key 是字段名称，在序列化之前执行
+	ColumnTransforms map[string]ColumnTransform `yaml:"columnTransforms" json:"columnTransforms"`
+
+	// 更新时只有这些字段变化才同步。为空时按 includeColumnNames、excludeColumnNames 之后的字段判断
+	TriggerColumns []string `yaml:"triggerColumns" json:"triggerColumns"`
+
 	// 字段名称格式，小驼峰: lowerCamelCase ，大驼峰：upperCamelCase 其他.不处理
 	FieldNameFormat string `yaml:"fieldNameFormat" json:"fieldNameFormat"`
 
+	// DECIMAL 的输出方式。number: 数字，string: 字符串。默认: number
+	DecimalFormat string `yaml:"decimalFormat" json:"decimalFormat"`
+
 	// redis 的配置
 	RedisRule SyncRedisRule `yaml:"redisRule" json:"redisRule"`
 
 	// elasticsearch 的配置
 	ElasticsearchRule SyncElasticsearchRule `yaml:"elasticsearchRule" json:"elasticsearchRule"`
+
+	// sink 不可用时，事件写入磁盘缓冲队列，恢复之后按顺序消费
+	Spool bool `yaml:"spool" json:"spool"`
 }
 
 type SyncRedisRule struct {
 	// redis 的 key 名称
 	KeyName string `yaml:"keyName" json:"keyName"`
 
-	// redis 的 key 类型。string or hash
+	// redis 的 key 类型。string、hash 或 stream，stream 按顺序 XADD 每个事件，包括删除
 	KeyType string `yaml:"keyType" json:"keyType"`
+
+	// stream 的最大长度，超过之后近似裁剪。默认: 0 不限制
+	StreamMaxLen int64 `yaml:"streamMaxLen" json:"streamMaxLen"`
 }
 
 type RedisConfig struct {
@@ -153,7 +250,120 @@ type ElasticsearchConfig struct {
 	Username string `yaml:"username" json:"username" `
 
 	Password string `yaml:"password" json:"password" `
+}
+
+type SpoolConfig struct {
+	// 单个分段文件的大小，单位 MB。默认: 64
+	SegmentSizeMB int64 `yaml:"segmentSizeMB" json:"segmentSizeMB"`
+
+	// 每个规则缓冲队列的最大大小，单位 MB，写满之后阻塞 binlog。默认: 1024
+	MaxSizeMB int64 `yaml:"maxSizeMB" json:"maxSizeMB"`
+
+	// sink 不可用时的重试间隔。默认: 3s
+	RetryInterval string `yaml:"retryInterval" json:"retryInterval"`
+
+	// 同一批事件最多重试的次数，超过之后逐个写入，失败的事件写入死信文件。默认: 0 一直重试，sink 拒绝的文档不重试
+	MaxRetries int `yaml:"maxRetries" json:"maxRetries"`
+}
+
+type EnrichRule struct {
+	// 用来查询的字段，例如 product_id
+	Column string `yaml:"column" json:"column"`
+
+	// 查询的表，库名.表名
+	Table string `yaml:"table" json:"table"`
+
+	// 查询的表中和 column 对应的字段。默认: id
+	Key string `yaml:"key" json:"key"`
+
+	// 查询的字段
+	Fields []string `yaml:"fields" json:"fields"`
+
+	// 合并到 After 时字段名称的前缀
+	Prefix string `yaml:"prefix" json:"prefix"`
+
+	// 缓存的数量。默认: 10000
+	CacheSize int `yaml:"cacheSize" json:"cacheSize"`
+}
+
+type DDLPolicy struct {
+	// 修改表结构。ignore: 忽略，mapping: 更新 es 的 mapping，reindex: 重新初始化这张表。默认: ignore
+	Alter string `yaml:"alter" json:"alter"`
+
+	// 清空表。ignore: 忽略，clear: 清空 sink 之后重新初始化规则的表。默认: ignore
+	Truncate string `yaml:"truncate" json:"truncate"`
+
+	// 删除表。ignore: 忽略，clear: 清空 sink 之后重新初始化规则剩下的表。默认: ignore
+	Drop string `yaml:"drop" json:"drop"`
+}
+
+type ScriptConfig struct {
+	// 每个事件的脚本执行时间限制，超时的事件写入死信文件。默认: 100ms
+	Timeout string `yaml:"timeout" json:"timeout"`
+}
+
+type SnapshotConfig struct {
+	// 同时读取的连接数，多张表、同一张表的多个主键范围并行读取。默认: 1
+	Workers int `yaml:"workers" json:"workers"`
+
+	// 整数主键的表拆分成多少个主键范围。默认: 1
+	ChunksPerTable int `yaml:"chunksPerTable" json:"chunksPerTable"`
+
+	// 每秒最多读取的行数，0 不限制
+	RowsPerSecond int `yaml:"rowsPerSecond" json:"rowsPerSecond"`
+
+	// 源库是从库时，Seconds_Behind_Master 超过多少秒暂停读取，0 不检查
+	MaxReplicaLagSeconds int64 `yaml:"maxReplicaLagSeconds" json:"maxReplicaLagSeconds"`
+
+	// 从库执行 FLUSH TABLES WITH READ LOCK 失败时不加锁继续，只按 gtid_executed 对齐。默认: false，加锁失败时退出
+	AllowReplicaWithoutLock bool `yaml:"allowReplicaWithoutLock" json:"allowReplicaWithoutLock"`
+}
+
+type TemporalConfig struct {
+	// DATETIME、DATE 写入时的时区，TIMESTAMP 不受影响。默认: Local
+	SourceTimezone string `yaml:"sourceTimezone" json:"sourceTimezone"`
+
+	// DATETIME、TIMESTAMP 输出的时区。默认: Local
+	OutputTimezone string `yaml:"outputTimezone" json:"outputTimezone"`
+
+	// DATE 的格式，go 的时间格式或者 epochMillis。默认: 2006-01-02
+	DateFormat string `yaml:"dateFormat" json:"dateFormat"`
+
+	// DATETIME 的格式，go 的时间格式或者 epochMillis。默认: 2006-01-02 15:04:05
+	DatetimeFormat string `yaml:"datetimeFormat" json:"datetimeFormat"`
+
+	// TIMESTAMP 的格式，go 的时间格式或者 epochMillis。默认: 2006-01-02 15:04:05
+	TimestampFormat string `yaml:"timestampFormat" json:"timestampFormat"`
+
+	// TIME 的格式，go 的时间格式或者 epochMillis (毫秒数)，超出一天的范围按 mysql 的格式输出。默认: 15:04:05
+	TimeFormat string `yaml:"timeFormat" json:"timeFormat"`
+}
+
+type SchemaRegistryConfig struct {
+	// Confluent 兼容的 schema registry 地址，例: http://127.0.0.1:8081 。为空使用本地文件
+	Url string `yaml:"url" json:"url"`
+
+	// basic 认证的用户名
+	Username string `yaml:"username" json:"username"`
+
+	// basic 认证的密码
+	Password string `yaml:"password" json:"password"`
+
+	// 本地文件的路径。默认: dataDir/schema_registry.json
+	Path string `yaml:"path" json:"path"`
+}
+
+type HttpConfig struct {
+	// http 服务监听地址，提供 /metrics 等接口，为空不启动。默认: 127.0.0.1:8090，只允许本机访问
+	Addr string `yaml:"addr" json:"addr"`
+}
+
+type HealthConfig struct {
+	// binlog 延迟超过多少秒，/readyz 返回未就绪，0 不检查。默认: 60
+	MaxLagSeconds uint32 `yaml:"maxLagSeconds" json:"maxLagSeconds"`
+}
 
-	// es 的 批量保存 间隔。默认 1s
-	FlushInterval string `yaml:"flushInterval" json:"flushInterval"`
+type AdminConfig struct {
+	// 管理接口的 token，请求头 Authorization: Bearer <token>。为空不开启管理接口
+	Token string `yaml:"token" json:"token"`
 }
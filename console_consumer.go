@@ -1,22 +1,66 @@
 package main
 
-import "log/slog"
+import (
+	"log/slog"
+	"strings"
+)
 
 type ConsoleConsumer struct {
+	// 事件的包装格式，为空只输出 after
+	Envelope string
+
+	// CloudEvents 的模式，binary 分开输出消息头和数据
+	CloudEventsMode string
+
+	// 同步的字段
+	Projection
+
 	*slog.Logger
 }
 
-func (c *ConsoleConsumer) BatchAccept(list []*EventData) {
+func (c *ConsoleConsumer) BatchAccept(list []*EventData) error {
 	for _, data := range list {
+		if c.Envelope == EnvelopeCloudEvents && c.CloudEventsMode == CloudEventsBinary {
+			event := CloudEvent("json", data, c.Projection)
+			buf := ConvertSerializationFormat("json", c.DecimalFormat, event["data"].(map[string]interface{}))
+			c.Info("Console Received :",
+				slog.Any("Headers", CloudEventHeaders(event)),
+				slog.String("Data", strings.TrimSpace(buf.String())),
+			)
+			continue
+		}
+		if len(c.Envelope) > 0 {
+			buf := ConvertSerializationFormat("json", c.DecimalFormat, WrapEnvelope(c.Envelope, "json", data, c.Projection))
+			c.Info("Console Received :", slog.String("Envelope", strings.TrimSpace(buf.String())))
+			continue
+		}
+		// before 和 after 一样只输出同步的字段
+		before, after := data.Before, data.After
+		if before != nil {
+			before = c.Project(before)
+		}
+		if after != nil {
+			after = c.WithSource(c.Project(after), data.Source)
+		}
 		c.Info("Console Received :",
 			slog.String("Action", data.Action),
 			slog.Any("PKColumns", data.PKColumns),
-			slog.Any("Before", data.Before),
-			slog.Any("After", data.After),
+			slog.Any("Before", before),
+			slog.Any("After", after),
 		)
 	}
+	return nil
+}
+
+func (c *ConsoleConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
 }
 
-func (c *ConsoleConsumer) Accept(data *EventData) {
-	c.BatchAccept([]*EventData{data})
+func (c *ConsoleConsumer) AcceptDDL(ev *DDLEvent) error {
+	c.Info("Console Received DDL :",
+		slog.String("Type", ev.Type),
+		slog.String("Table", ev.Schema+"."+ev.Table),
+		slog.String("Query", ev.Query),
+	)
+	return nil
 }
@@ -1,7 +1,12 @@
 package main
 
 type Consumer interface {
-	Accept(*EventData)
+	Accept(*EventData) error
 
-	BatchAccept([]*EventData)
+	BatchAccept([]*EventData) error
+}
+
+// Clearable 支持清空之前数据的消费者
+type Clearable interface {
+	ClearBeforeData()
 }
@@ -20,8 +20,11 @@ var (
 	causer = cases.Title(language.English)
 )
 
-// ConvertColumn 字段转换
-func ConvertColumn(fieldNameFormat, column string) string {
+// ConvertColumn 字段转换，配置了重命名的字段直接使用新的名称
+func ConvertColumn(fieldNameFormat string, rename map[string]string, column string) string {
+	if name, ok := rename[strings.ToLower(column)]; ok {
+		return name
+	}
 	switch fieldNameFormat {
 	case "lowerCamelCase":
 		return lowerCamelCase(column)
@@ -32,23 +35,10 @@ func ConvertColumn(fieldNameFormat, column string) string {
 	}
 }
 
-// ConvertSerializationFormat 转数据格式
-func ConvertSerializationFormat(format string, data map[string]interface{}) bytes.Buffer {
+// ConvertSerializationFormat 转数据格式，decimalFormat 是 DECIMAL 的输出方式
+func ConvertSerializationFormat(format, decimalFormat string, data map[string]interface{}) bytes.Buffer {
 	for key, val := range data {
-		switch newVal := val.(type) {
-		case int8:
-			data[key] = int32(newVal)
-			break
-		case []uint8:
-			data[key] = string(newVal)
-			break
-		case int16:
-			data[key] = int32(newVal)
-			break
-		case time.Time:
-			data[key] = ConvertTimeToString(newVal)
-			break
-		}
+		data[key] = serializeValue(format, decimalFormat, val)
 	}
 	var buf bytes.Buffer
 	switch format {
@@ -123,6 +113,11 @@ func ConvertAnyToString(value interface{}) string {
 		return strconv.Itoa(v)
 	case float64:
 		return strconv.FormatFloat(v, 'g', -1, 64)
+	case map[string]interface{}, []interface{}:
+		if s, ok := jsonString(v); ok {
+			return s
+		}
+		return fmt.Sprintf("%v", value)
 	default:
 		return fmt.Sprintf("%v", value)
 	}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,3 +25,75 @@ func Test002(t *testing.T) {
 		fmt.Println(newVal.Format(time.RFC3339))
 	}
 }
+
+func TestConvertColumnValue(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "t_device"}
+	table.AddColumn("price", "decimal(20,4)", "", "")
+	table.AddColumn("status", "enum('on','off')", "utf8mb4_general_ci", "")
+	table.AddColumn("tags", "set('a','b','c')", "utf8mb4_general_ci", "")
+	table.AddColumn("attrs", "json", "", "")
+	table.AddColumn("raw", "blob", "", "")
+	table.AddColumn("counter", "bigint(20) unsigned", "", "")
+	row := anyToObj([]interface{}{
+		decimal.RequireFromString("12345678901234567.8901"),
+		int64(2),
+		int64(5),
+		[]byte(`{"id": 9007199254740993}`),
+		[]byte{0xff, 0x00},
+		uint64(18446744073709551615),
+	}, table)
+	buf := ConvertSerializationFormat("json", DecimalNumber, row)
+	want := `{"attrs":{"id":9007199254740993},"counter":18446744073709551615,"price":12345678901234567.8901,"raw":"/wA=","status":"off","tags":"a,c"}`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSerializeLargeInteger(t *testing.T) {
+	// protobuf 的 Value 只有 double，超过 2^53 的整数按字符串输出
+	cases := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{int64(9007199254740993), "9007199254740993"},
+		{int64(-9007199254740993), "-9007199254740993"},
+		{int(9007199254740993), "9007199254740993"},
+		{int64(9007199254740992), int64(9007199254740992)},
+		{uint64(18446744073709551615), "18446744073709551615"},
+	}
+	for _, c := range cases {
+		if got := serializeValue("protobuf", DecimalNumber, c.value); got != c.want {
+			t.Errorf("serialize %v got %#v, want %#v", c.value, got, c.want)
+		}
+	}
+	if got := serializeValue("json", DecimalNumber, int64(9007199254740993)); got != int64(9007199254740993) {
+		t.Errorf("json got %#v", got)
+	}
+}
+
+func TestTemporalValue(t *testing.T) {
+	sourceLocation, outputLocation = time.UTC, time.UTC
+	defer func() { sourceLocation, outputLocation = time.Local, time.Local }()
+	table := &schema.Table{Schema: "test", Name: "t_order"}
+	table.AddColumn("pay_date", "date", "", "")
+	table.AddColumn("create_time", "datetime", "", "")
+	table.AddColumn("update_time", "timestamp", "", "")
+	table.AddColumn("duration", "time", "", "")
+	table.AddColumn("cancel_time", "datetime", "", "")
+	// binlog 中的字符串和初始化数据读取的值输出相同
+	binlogRow := anyToObj([]interface{}{"2024-07-03", "2024-07-03 00:00:00", "2024-07-02 16:00:00", "-838:59:59", "0000-00-00 00:00:00"}, table)
+	snapshotRow := ConvertRowValues(table, map[string]interface{}{
+		"pay_date":    time.Date(2024, 7, 3, 0, 0, 0, 0, time.UTC),
+		"create_time": time.Date(2024, 7, 3, 0, 0, 0, 0, time.UTC),
+		"update_time": time.Date(2024, 7, 2, 16, 0, 0, 0, time.UTC),
+		"duration":    []byte("-838:59:59"),
+		"cancel_time": time.Time{},
+	})
+	want := `{"cancel_time":null,"create_time":"2024-07-03 00:00:00","duration":"-838:59:59","pay_date":"2024-07-03","update_time":"2024-07-02 16:00:00"}`
+	for _, row := range []map[string]interface{}{binlogRow, snapshotRow} {
+		buf := ConvertSerializationFormat("json", DecimalNumber, row)
+		if got := strings.TrimSpace(buf.String()); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DecimalNumber json、yaml 中按精确的数字输出，msgpack、protobuf 没有精确的小数类型，按 float64 输出
+	DecimalNumber = "number"
+	// DecimalString 按字符串输出
+	DecimalString = "string"
+)
+
+// protobufMaxSafeInteger protobuf 的 Value 只有 double，超过的整数按字符串输出
+const protobufMaxSafeInteger = 1 << 53
+
+// ConvertColumnValue 按字段类型把 binlog 或者初始化数据读取的值转成统一的类型:
+// DECIMAL 转成 decimal.Decimal，ENUM、SET 转成名称，JSON 解析成对象，BIT 转成整数，
+// 二进制字段保持 []byte，其他字符串字段转成 string
+func ConvertColumnValue(column *schema.TableColumn, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch column.Type {
+	case schema.TYPE_ENUM:
+		// binlog 中是从 1 开始的序号，初始化数据是名称
+		if n, ok := columnInt(value); ok {
+			if n > 0 && int(n) <= len(column.EnumValues) {
+				return column.EnumValues[n-1]
+			}
+			return ""
+		}
+	case schema.TYPE_SET:
+		// binlog 中是按位的集合
+		if n, ok := columnInt(value); ok {
+			var labels []string
+			for i, label := range column.SetValues {
+				if n&(1<<i) != 0 {
+					labels = append(labels, label)
+				}
+			}
+			return strings.Join(labels, ",")
+		}
+	case schema.TYPE_DECIMAL:
+		switch v := value.(type) {
+		case decimal.Decimal:
+			return v
+		case float64:
+			return decimal.NewFromFloat(v)
+		case string, []byte:
+			if d, err := decimal.NewFromString(ConvertAnyToString(v)); err == nil {
+				return d
+			}
+		}
+	case schema.TYPE_JSON:
+		switch value.(type) {
+		case string, []byte:
+			decoder := json.NewDecoder(strings.NewReader(ConvertAnyToString(value)))
+			// 保留大整数的精度
+			decoder.UseNumber()
+			var v interface{}
+			if err := decoder.Decode(&v); err == nil {
+				return v
+			}
+			return ConvertAnyToString(value)
+		}
+	case schema.TYPE_DATE, schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_TIME:
+		return newTemporalValue(column.Type, value)
+	case schema.TYPE_BIT:
+		// 初始化数据读取的是大端字节
+		if b, ok := value.([]byte); ok && len(b) <= 8 {
+			return binary.BigEndian.Uint64(append(make([]byte, 8-len(b)), b...))
+		}
+	}
+	if isBinaryColumn(column) {
+		if s, ok := value.(string); ok {
+			return []byte(s)
+		}
+		return value
+	}
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return value
+}
+
+// ConvertRowValues 按表结构转换初始化数据读取的一行
+func ConvertRowValues(table *schema.Table, row map[string]interface{}) map[string]interface{} {
+	newRow := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		newRow[column] = value
+	}
+	for i := range table.Columns {
+		column := &table.Columns[i]
+		if value, ok := row[column.Name]; ok {
+			newRow[column.Name] = ConvertColumnValue(column, value)
+		}
+	}
+	return newRow
+}
+
+// QueryTableSchema 查询表结构，和 canal 解析的结构相同
+func QueryTableSchema(db *gorm.DB, schemaName, tableName string) (*schema.Table, error) {
+	var columns []struct {
+		Field     string
+		Type      string
+		Collation *string
+		Extra     string
+	}
+	err := db.Raw(fmt.Sprintf("SHOW FULL COLUMNS FROM %s.%s", quoteIdentifier(schemaName), quoteIdentifier(tableName))).
+		Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+	table := &schema.Table{Schema: schemaName, Name: tableName}
+	for _, column := range columns {
+		collation := ""
+		if column.Collation != nil {
+			collation = *column.Collation
+		}
+		table.AddColumn(column.Field, column.Type, collation, column.Extra)
+	}
+	return table, nil
+}
+
+// isBinaryColumn BINARY、VARBINARY、BLOB 字段
+func isBinaryColumn(column *schema.TableColumn) bool {
+	return column.Type == schema.TYPE_BINARY || strings.Contains(column.RawType, "blob")
+}
+
+func columnInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// serializeValue 按序列化格式转换值
+func serializeValue(format, decimalFormat string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return int32(v)
+	case int16:
+		return int32(v)
+	case time.Time:
+		return ConvertTimeToString(v)
+	case TemporalValue:
+		return v.Format()
+	case decimal.Decimal:
+		if decimalFormat == DecimalString {
+			return v.String()
+		}
+		switch format {
+		case "json":
+			return json.Number(v.String())
+		case "yaml":
+			return yamlDecimal(v.String())
+		}
+		f, _ := v.Float64()
+		return f
+	case []byte:
+		// msgpack 支持二进制，其他格式按 base64 输出
+		if format == "msgpack" {
+			return v
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case uint64:
+		if format == "protobuf" && v > protobufMaxSafeInteger {
+			return strconv.FormatUint(v, 10)
+		}
+	case int64:
+		if format == "protobuf" && (v > protobufMaxSafeInteger || v < -protobufMaxSafeInteger) {
+			return strconv.FormatInt(v, 10)
+		}
+	case int:
+		if format == "protobuf" && (v > protobufMaxSafeInteger || v < -protobufMaxSafeInteger) {
+			return strconv.Itoa(v)
+		}
+	case json.Number:
+		if format == "json" {
+			return v
+		}
+		if n, err := v.Int64(); err == nil {
+			return serializeValue(format, decimalFormat, n)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		newMap := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			newMap[key] = serializeValue(format, decimalFormat, val)
+		}
+		return newMap
+	case []interface{}:
+		newList := make([]interface{}, len(v))
+		for i, val := range v {
+			newList[i] = serializeValue(format, decimalFormat, val)
+		}
+		return newList
+	}
+	return value
+}
+
+// yamlDecimal yaml 中不加引号输出的小数
+type yamlDecimal string
+
+func (d yamlDecimal) MarshalYAML() (interface{}, error) {
+	tag := "!!int"
+	if strings.ContainsAny(string(d), ".eE") {
+		tag = "!!float"
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: string(d)}, nil
+}
+
+// jsonString 对象、数组按 json 转成字符串
+func jsonString(value interface{}) (string, bool) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(value); err == nil {
+			return strings.TrimSuffix(buf.String(), "\n"), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DDLAction DDL 事件的 Action
+const DDLAction = "ddl"
+
+const (
+	DDLAlter    = "alter"
+	DDLCreate   = "create"
+	DDLDrop     = "drop"
+	DDLTruncate = "truncate"
+	DDLRename   = "rename"
+	DDLIndex    = "index"
+)
+
+const (
+	DDLPolicyIgnore  = "ignore"
+	DDLPolicyMapping = "mapping"
+	DDLPolicyReindex = "reindex"
+	DDLPolicyClear   = "clear"
+)
+
+// DDLEvent 表结构变化
+type DDLEvent struct {
+	// alter、create、drop、truncate、rename、index
+	Type string
+	// 库名
+	Schema string
+	// 表名
+	Table string
+	// 原始的 DDL 语句
+	Query string
+}
+
+// DDLAcceptor 支持 DDL 事件的 sink
+type DDLAcceptor interface {
+	AcceptDDL(*DDLEvent) error
+}
+
+// MappingUpdater 可以按表结构更新 mapping 的 sink
+type MappingUpdater interface {
+	UpdateMapping(*schema.Table) error
+}
+
+var ddlCommentRegex = regexp.MustCompile(`(?s)^\s*(/\*.*?\*/\s*)*`)
+
+// ParseDDLType 按 DDL 语句的开头判断类型
+func ParseDDLType(query string) string {
+	words := strings.Fields(strings.ToUpper(ddlCommentRegex.ReplaceAllString(query, "")))
+	if len(words) == 0 {
+		return ""
+	}
+	second := ""
+	for _, word := range words[1:] {
+		// CREATE UNIQUE INDEX、DROP TEMPORARY TABLE 等
+		if !slices.Contains([]string{"TEMPORARY", "UNIQUE", "FULLTEXT", "SPATIAL", "ONLINE", "OFFLINE"}, word) {
+			second = word
+			break
+		}
+	}
+	switch words[0] {
+	case "ALTER":
+		return DDLAlter
+	case "TRUNCATE":
+		return DDLTruncate
+	case "RENAME":
+		return DDLRename
+	case "CREATE":
+		if second == "INDEX" {
+			return DDLIndex
+		}
+		return DDLCreate
+	case "DROP":
+		if second == "INDEX" {
+			return DDLIndex
+		}
+		return DDLDrop
+	}
+	return ""
+}
+
+// DDLConsumer 按顺序处理规则管道中的 DDL 事件，其他事件写入 sink
+type DDLConsumer struct {
+	Consumer
+
+	Rule *EventRule
+}
+
+func (c *DDLConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
+}
+
+func (c *DDLConsumer) BatchAccept(list []*EventData) error {
+	start := 0
+	for i, data := range list {
+		if data.DDL == nil {
+			continue
+		}
+		if i > start {
+			if err := c.Consumer.BatchAccept(list[start:i]); err != nil {
+				return err
+			}
+		}
+		if err := c.Rule.applyDDL(data.DDL, data.Schema); err != nil {
+			return err
+		}
+		start = i + 1
+	}
+	if start < len(list) {
+		return c.Consumer.BatchAccept(list[start:])
+	}
+	return nil
+}
+
+// applyDDL 写入支持 DDL 的 sink，再按规则的策略处理。table 是结构历史中 DDL 之后的表结构
+func (r *EventRule) applyDDL(ev *DDLEvent, table *schema.Table) error {
+	if acceptor, ok := r.sink.(DDLAcceptor); ok {
+		if err := acceptor.AcceptDDL(ev); err != nil {
+			return err
+		}
+	}
+	tableName := fmt.Sprintf("%s.%s", ev.Schema, ev.Table)
+	policy := DDLPolicyIgnore
+	switch ev.Type {
+	case DDLAlter:
+		policy = r.Rule.DDL.Alter
+	case DDLTruncate:
+		policy = r.Rule.DDL.Truncate
+	case DDLDrop:
+		policy = r.Rule.DDL.Drop
+	}
+	slog.Info("ddl", slog.String("rule", r.Name), slog.String("table", tableName),
+		slog.String("type", ev.Type), slog.String("policy", policy))
+	switch policy {
+	case DDLPolicyMapping:
+		updater, ok := r.sink.(MappingUpdater)
+		if !ok || table == nil {
+			return nil
+		}
+		return updater.UpdateMapping(table)
+	case DDLPolicyReindex:
+		// 重新初始化这张表，覆盖之前的数据
+		if err := Resnapshot(r, tableName); err != nil {
+			slog.Error("ddl reindex", slog.String("rule", r.Name), slog.Any("err", err))
+			return err
+		}
+	case DDLPolicyClear:
+		// sink 可能包含规则的多张表，清空之后重新初始化剩下的表
+		r.ClearBeforeData()
+		if snapshotDB == nil {
+			return nil
+		}
+		tableNames, err := QueryTableNames(snapshotDB)
+		if err != nil {
+			return err
+		}
+		tableNames = slices.DeleteFunc(tableNames, func(item string) bool {
+			return !r.Reg.MatchString(item)
+		})
+		if len(tableNames) > 0 {
+			ClearSnapshotProgress(r.Name, tableNames)
+			if err = r.StartSnapshot(snapshotDB, tableNames, nil); err != nil {
+				slog.Error("ddl resnapshot", slog.String("rule", r.Name), slog.Any("err", err))
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// esMappingProperties 按表结构生成 es 的 mapping，跳过已经存在的字段
+func esMappingProperties(projection Projection, table *schema.Table, existing map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, column := range table.Columns {
+		if !projection.Included(column.Name) {
+			continue
+		}
+		var mapping map[string]interface{}
+		if _, transformed := projection.ColumnTransforms[strings.ToLower(column.Name)]; transformed {
+			mapping = map[string]interface{}{"type": "keyword"}
+		} else {
+			mapping = esColumnMapping(column)
+		}
+		name := ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, column.Name)
+		if _, ok := existing[name]; ok || mapping == nil {
+			continue
+		}
+		properties[name] = mapping
+	}
+	return properties
+}
+
+// esColumnMapping mysql 字段类型对应的 es 类型，无法确定时返回空，交给动态 mapping
+func esColumnMapping(column schema.TableColumn) map[string]interface{} {
+	switch column.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT, schema.TYPE_BIT:
+		return map[string]interface{}{"type": "long"}
+	case schema.TYPE_FLOAT, schema.TYPE_DECIMAL:
+		return map[string]interface{}{"type": "double"}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		return map[string]interface{}{
+			"type":   "date",
+			"format": "yyyy-MM-dd HH:mm:ss||yyyy-MM-dd||strict_date_optional_time||epoch_millis",
+		}
+	case schema.TYPE_STRING:
+		if isBinaryColumn(&column) {
+			return map[string]interface{}{"type": "binary"}
+		}
+		if strings.Contains(column.RawType, "text") {
+			return map[string]interface{}{"type": "text"}
+		}
+		return map[string]interface{}{"type": "keyword"}
+	case schema.TYPE_BINARY:
+		return map[string]interface{}{"type": "binary"}
+	case schema.TYPE_ENUM, schema.TYPE_SET:
+		return map[string]interface{}{"type": "keyword"}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DeadLetter 无法处理的事件，按行写入数据目录的 deadletter/<规则名称>.jsonl
+type DeadLetter struct {
+	Time  time.Time  `json:"time"`
+	Rule  string     `json:"rule"`
+	Error string     `json:"error"`
+	Event *EventData `json:"event"`
+}
+
+var deadLetterMu sync.Mutex
+
+// WriteDeadLetter 记录无法处理的事件，之后可以人工处理或者重新导入
+func WriteDeadLetter(ruleName string, data *EventData, cause error) {
+	eventsDeadLettered.WithLabelValues(ruleName).Inc()
+	line, err := json.Marshal(DeadLetter{Time: time.Now(), Rule: ruleName, Error: cause.Error(), Event: data})
+	if err != nil {
+		slog.Error("dead letter marshal", slog.String("rule", ruleName), slog.Any("err", err))
+		return
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	dir := filepath.Join(Config.DataDir, "deadletter")
+	if err = os.MkdirAll(dir, 0755); err == nil {
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(dir, ruleName+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		slog.Error("dead letter write", slog.String("rule", ruleName), slog.Any("err", err))
+		return
+	}
+	slog.Warn("dead letter", slog.String("rule", ruleName), slog.String("table", data.TableName), slog.Any("cause", cause))
+}
+
+// permanentError sink 拒绝的事件，重试也不会成功，例如 mapping 错误、文档过大、序列化失败
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent 标记为重试也不会成功的错误，缓冲队列不再重试，写入死信文件
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent 是否是重试也不会成功的错误
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
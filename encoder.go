@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/samber/lo"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RowEncoder 按事件的表结构序列化投影之后的行，表结构变化之后重新生成
+type RowEncoder interface {
+	Marshal(table *schema.Table, row map[string]interface{}) ([]byte, error)
+	Invalidate(tableName string)
+}
+
+var safeNameChar = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// schemaField 按表结构序列化的字段
+type schemaField struct {
+	// 写入 sink 的字段名称
+	Key string
+	// 对应的表字段，计算字段、查询字段、脱敏的字段为空，按字符串输出
+	Column *schema.TableColumn
+}
+
+// schemaFields 表的字段：同步的字段、计算字段、合并的查询字段
+func schemaFields(projection Projection, enrich []EnrichRule, table *schema.Table) []schemaField {
+	var fields []schemaField
+	for i := range table.Columns {
+		column := &table.Columns[i]
+		if !projection.Included(column.Name) {
+			continue
+		}
+		field := schemaField{Key: ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, column.Name)}
+		if _, transformed := projection.ColumnTransforms[strings.ToLower(column.Name)]; !transformed {
+			field.Column = column
+		}
+		fields = append(fields, field)
+	}
+	for _, field := range projection.ComputedFields {
+		fields = append(fields, schemaField{Key: ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, field.Name)})
+	}
+	for _, rule := range enrich {
+		for _, field := range rule.Fields {
+			fields = append(fields, schemaField{Key: ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, rule.Prefix+field)})
+		}
+	}
+	// 转换之后名称相同的字段只保留第一个
+	return lo.UniqBy(fields, func(item schemaField) string {
+		return safeFieldName(item.Key)
+	})
+}
+
+// safeFieldName protobuf、avro 的名称只能包含字母、数字、下划线，并且不能以数字开头
+func safeFieldName(name string) string {
+	name = safeNameChar.ReplaceAllString(name, "_")
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// safeTypeName 消息、record 的名称，大驼峰之后仍然不能以数字开头
+func safeTypeName(name string) string {
+	return safeFieldName(upperCamelCase(safeFieldName(name)))
+}
+
+// sameEncodedColumns 序列化用到的字段定义都相同，不需要重新生成结构
+func sameEncodedColumns(a, b *schema.Table) bool {
+	return a == b || slices.EqualFunc(a.Columns, b.Columns, func(x, y schema.TableColumn) bool {
+		// DECIMAL 的精度、FLOAT 和 DOUBLE 只在 RawType 中
+		return sameColumn(x, y) && (x.Type != schema.TYPE_DECIMAL && x.Type != schema.TYPE_FLOAT || x.RawType == y.RawType)
+	})
+}
+
+// queriedTables 初始化数据时查询的表结构，binlog 同步开始之后使用 canal 的表结构
+var queriedTables sync.Map
+
+// loadTableSchema binlog 同步中使用 canal 的表结构，否则查询数据库
+func loadTableSchema(tableName string) (*schema.Table, error) {
+	s1 := strings.SplitN(tableName, ".", 2)
+	if len(s1) != 2 {
+		return nil, fmt.Errorf("invalid table name %s", tableName)
+	}
+	if mysqlCanal != nil {
+		return mysqlCanal.GetTable(s1[0], s1[1])
+	}
+	if mysqlDB == nil {
+		return nil, fmt.Errorf("mysql not connected")
+	}
+	if table, ok := queriedTables.Load(tableName); ok {
+		return table.(*schema.Table), nil
+	}
+	table, err := QueryTableSchema(mysqlDB, s1[0], s1[1])
+	if err != nil {
+		return nil, err
+	}
+	queriedTables.Store(tableName, table)
+	return table, nil
+}
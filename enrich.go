@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/samber/lo"
+	"github.com/shopspring/decimal"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const defaultLookupCacheSize = 10000
+
+// Lookup 按字段的值查询另一张表，结果缓存在 LRU 中，查询的表变化时从 binlog 失效
+type Lookup struct {
+	EnrichRule
+
+	mu    sync.Mutex
+	cache *lruCache
+	// 每次失效加一，查询期间失效的结果不写入缓存
+	generation uint64
+}
+
+var (
+	lookupsMu sync.RWMutex
+	// 按查询的表名称索引，binlog 事件用来失效缓存
+	lookups = map[string][]*Lookup{}
+)
+
+// NewLookup 创建查询
+func NewLookup(rule EnrichRule) (*Lookup, error) {
+	if len(rule.Column) == 0 || len(rule.Fields) == 0 || !strings.Contains(rule.Table, ".") {
+		return nil, fmt.Errorf("enrich %s: column, table (库名.表名) and fields are required", rule.Column)
+	}
+	if len(rule.Key) == 0 {
+		rule.Key = "id"
+	}
+	if rule.CacheSize <= 0 {
+		rule.CacheSize = defaultLookupCacheSize
+	}
+	return &Lookup{EnrichRule: rule, cache: newLRUCache(rule.CacheSize)}, nil
+}
+
+// RegisterLookups 注册查询，查询的表变化时失效缓存
+func RegisterLookups(list []*Lookup) {
+	lookupsMu.Lock()
+	defer lookupsMu.Unlock()
+	for _, lookup := range list {
+		lookups[lookup.Table] = append(lookups[lookup.Table], lookup)
+	}
+}
+
+// UnregisterLookups 注销查询
+func UnregisterLookups(list []*Lookup) {
+	lookupsMu.Lock()
+	defer lookupsMu.Unlock()
+	for _, lookup := range list {
+		lookups[lookup.Table] = slices.DeleteFunc(lookups[lookup.Table], func(item *Lookup) bool {
+			return item == lookup
+		})
+		if len(lookups[lookup.Table]) == 0 {
+			delete(lookups, lookup.Table)
+		}
+	}
+}
+
+// LookupTables 所有查询的表，binlog 需要包含这些表
+func LookupTables(rules map[string]SyncRule) []string {
+	var tables []string
+	for _, rule := range rules {
+		for _, enrich := range rule.Enrich {
+			tables = append(tables, enrich.Table)
+		}
+	}
+	return lo.Uniq(tables)
+}
+
+// InvalidateLookups 查询的表变化时，失效变化之前和之后的 key
+func InvalidateLookups(tableName string, list []*EventData) {
+	lookupsMu.RLock()
+	defer lookupsMu.RUnlock()
+	for _, lookup := range lookups[tableName] {
+		lookup.mu.Lock()
+		lookup.generation++
+		for _, data := range list {
+			if data.Before != nil {
+				lookup.cache.Remove(lookupKey(data.Before[lookup.Key]))
+			}
+			if data.After != nil {
+				lookup.cache.Remove(lookupKey(data.After[lookup.Key]))
+			}
+		}
+		lookup.mu.Unlock()
+	}
+}
+
+// lookupValue 查询和缓存使用的值。DECIMAL 去掉末尾的 0，时间按 mysql 的字面值，TIMESTAMP 按查询连接的 UTC
+func lookupValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case decimal.Decimal:
+		return v.String()
+	case TemporalValue:
+		if v.Type == schema.TYPE_TIMESTAMP {
+			return v.Time.UTC().Format("2006-01-02 15:04:05.999999")
+		}
+		return v.String()
+	}
+	return value
+}
+
+// lookupKey 缓存的 key，查询和失效使用相同的转换
+func lookupKey(value interface{}) string {
+	return ConvertAnyToString(lookupValue(value))
+}
+
+// Get 查询字段，没有找到时返回空。没有找到的结果同样缓存
+func (l *Lookup) Get(value interface{}) (map[string]interface{}, error) {
+	value = lookupValue(value)
+	key := ConvertAnyToString(value)
+	l.mu.Lock()
+	row, ok := l.cache.Get(key)
+	generation := l.generation
+	l.mu.Unlock()
+	if ok {
+		return row, nil
+	}
+	if mysqlDB == nil {
+		return nil, fmt.Errorf("mysql not connected")
+	}
+	var result []map[string]interface{}
+	err := mysqlDB.Table(l.Table).
+		Select(lo.Map(l.Fields, func(item string, index int) string {
+			return quoteIdentifier(item)
+		})).
+		Where(fmt.Sprintf("%s = ?", quoteIdentifier(l.Key)), value).
+		Limit(1).
+		Find(&result).Error
+	if err != nil {
+		return nil, fmt.Errorf("enrich %s from %s: %w", l.Column, l.Table, err)
+	}
+	if len(result) > 0 {
+		row = result[0]
+	}
+	l.mu.Lock()
+	if l.generation == generation {
+		l.cache.Add(key, row)
+	}
+	l.mu.Unlock()
+	return row, nil
+}
+
+// EnrichConsumer 写入 sink 之前，把查询到的字段合并到 After
+type EnrichConsumer struct {
+	Consumer
+
+	// 规则名称，查询失败的事件写入这个规则的死信文件
+	RuleName string
+	// 规则开启了磁盘缓冲队列，查询失败时返回错误，由缓冲队列重试
+	Spool bool
+
+	Lookups []*Lookup
+}
+
+func (c *EnrichConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
+}
+
+func (c *EnrichConsumer) BatchAccept(list []*EventData) error {
+	newList := make([]*EventData, 0, len(list))
+	for _, data := range list {
+		if data.After == nil {
+			newList = append(newList, data)
+			continue
+		}
+		// 不修改原来的事件，其他规则也会使用
+		after := make(map[string]interface{}, len(data.After))
+		for column, value := range data.After {
+			after[column] = value
+		}
+		var err error
+		for _, lookup := range c.Lookups {
+			value := data.After[lookup.Column]
+			if value == nil {
+				continue
+			}
+			var row map[string]interface{}
+			if row, err = lookup.Get(value); err != nil {
+				break
+			}
+			for _, field := range lookup.Fields {
+				after[lookup.Prefix+field] = row[field]
+			}
+		}
+		if err != nil {
+			if c.Spool {
+				return err
+			}
+			// 没有缓冲队列时，查询失败的事件写入死信文件，不阻塞后面的事件
+			WriteDeadLetter(c.RuleName, data, err)
+			continue
+		}
+		newData := *data
+		newData.After = after
+		newList = append(newList, &newData)
+	}
+	return c.Consumer.BatchAccept(newList)
+}
+
+// lruCache 最近最少使用的缓存，调用方负责加锁
+type lruCache struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value map[string]interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) Get(key string) (map[string]interface{}, bool) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+func (c *lruCache) Add(key string, value map[string]interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Remove(key string) {
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
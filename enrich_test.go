@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/shopspring/decimal"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupDecimalKey(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	lookup, err := NewLookup(EnrichRule{Column: "level_price", Table: "test.t_level", Key: "price", Fields: []string{"name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterLookups([]*Lookup{lookup})
+	defer UnregisterLookups([]*Lookup{lookup})
+	// 查询过的结果，DECIMAL(10,2) 的 12.50
+	lookup.cache.Add(lookupKey(decimal.RequireFromString("12.50")), map[string]interface{}{"name": "gold"})
+
+	record := &recordConsumer{}
+	consumer := &EnrichConsumer{Consumer: record, RuleName: "test", Lookups: []*Lookup{lookup}}
+	event := &EventData{Action: canal.InsertAction, TableName: "test.t_user",
+		After: map[string]interface{}{"id": 1, "level_price": decimal.RequireFromString("12.5")}}
+	if err = consumer.Accept(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(record.list) != 1 || record.list[0].After["name"] != "gold" {
+		t.Fatalf("enriched %v", record.list)
+	}
+
+	// 查询的表修改之后失效，没有连接 mysql，查询失败的事件写入死信文件
+	InvalidateLookups("test.t_level", []*EventData{{Action: canal.UpdateAction,
+		Before: map[string]interface{}{"price": decimal.RequireFromString("12.500")},
+		After:  map[string]interface{}{"price": decimal.RequireFromString("13.00")}}})
+	if err = consumer.Accept(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(record.list) != 1 {
+		t.Fatalf("failed lookup delivered %v", record.list)
+	}
+	if _, err = os.Stat(filepath.Join(Config.DataDir, "deadletter", "test.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	// 开启缓冲队列时返回错误，由缓冲队列重试
+	consumer.Spool = true
+	if err = consumer.Accept(event); err == nil {
+		t.Fatal("lookup error not returned with spool")
+	}
+}
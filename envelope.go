@@ -0,0 +1,287 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/samber/lo"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EnvelopeDebezium 按 Debezium 的格式包装事件
+	EnvelopeDebezium = "debezium"
+	// EnvelopeCanal 按阿里 Canal 的 FlatMessage 格式包装事件
+	EnvelopeCanal = "canal"
+	// EnvelopeMaxwell 按 Maxwell 的格式包装事件
+	EnvelopeMaxwell = "maxwell"
+)
+
+// canalMessageID FlatMessage 的 id，进程内递增
+var canalMessageID atomic.Int64
+
+// WrapEnvelope 按格式包装事件，format 是包装之后的序列化格式
+func WrapEnvelope(envelope, format string, data *EventData, projection Projection) map[string]interface{} {
+	switch envelope {
+	case EnvelopeCloudEvents:
+		return CloudEvent(format, data, projection)
+	case EnvelopeCanal:
+		return CanalFlatMessage(data, projection)
+	case EnvelopeMaxwell:
+		return MaxwellMessage(data, projection)
+	default:
+		return DebeziumEnvelope(data, projection)
+	}
+}
+
+// EventSource 事件的来源，binlog 的位置或者初始化数据
+type EventSource struct {
+	// binlog 文件
+	File string
+	// 事件结束的位置
+	Pos uint32
+	// 事务的 GTID
+	GTID string
+	// mysql 的 server_id
+	ServerID uint32
+	// 事件写入 binlog 的时间，毫秒
+	TsMs int64
+	// 事务的编号，GTID 或者事务中第一个行事件的位置
+	TxID string
+	// 初始化数据读取的行
+	Snapshot bool
+}
+
+// Fields 写入行的来源字段
+func (s *EventSource) Fields() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	fields := map[string]interface{}{
+		"file":      s.File,
+		"pos":       s.Pos,
+		"server_id": s.ServerID,
+		"ts_ms":     s.TsMs,
+		"snapshot":  s.Snapshot,
+	}
+	if len(s.GTID) > 0 {
+		fields["gtid"] = s.GTID
+	}
+	if len(s.TxID) > 0 {
+		fields["tx_id"] = s.TxID
+	}
+	return fields
+}
+
+// DebeziumEnvelope 包装成 {before, after, source, op, ts_ms}，初始化数据的 op 是 r
+func DebeziumEnvelope(data *EventData, projection Projection) map[string]interface{} {
+	var before, after map[string]interface{}
+	if data.Before != nil {
+		before = projection.Project(data.Before)
+	}
+	if data.After != nil {
+		after = projection.Project(data.After)
+	}
+	src := data.Source
+	if src == nil {
+		src = &EventSource{}
+	}
+	op := "c"
+	switch {
+	case src.Snapshot:
+		op = "r"
+	case data.Action == canal.UpdateAction:
+		op = "u"
+	case data.Action == canal.DeleteAction:
+		op = "d"
+	}
+	db, table, _ := strings.Cut(data.TableName, ".")
+	source := map[string]interface{}{
+		"connector": "mysql",
+		"name":      Config.AppName,
+		"ts_ms":     src.TsMs,
+		"snapshot":  lo.Ternary(src.Snapshot, "true", "false"),
+		"db":        db,
+		"table":     table,
+		"server_id": src.ServerID,
+		"gtid":      nil,
+		"file":      src.File,
+		"pos":       src.Pos,
+	}
+	if len(src.GTID) > 0 {
+		source["gtid"] = src.GTID
+	}
+	return map[string]interface{}{
+		"before": before,
+		"after":  after,
+		"source": source,
+		"op":     op,
+		"ts_ms":  time.Now().UnixMilli(),
+	}
+}
+
+// eventSchema 事件位置的表结构，没有时查询当前的结构
+func eventSchema(data *EventData) (*schema.Table, error) {
+	if data.Schema != nil {
+		return data.Schema, nil
+	}
+	return loadTableSchema(data.TableName)
+}
+
+// CanalFlatMessage 包装成 Canal 的 FlatMessage，data、old 中的值都是字符串，old 只包含变化的字段
+func CanalFlatMessage(data *EventData, projection Projection) map[string]interface{} {
+	src := data.Source
+	if src == nil {
+		src = &EventSource{}
+	}
+	db, table, _ := strings.Cut(data.TableName, ".")
+	row, old := data.After, map[string]interface{}(nil)
+	if data.Action == canal.DeleteAction {
+		row = data.Before
+	}
+	row = projection.Project(row)
+	if data.Action == canal.UpdateAction {
+		before := projection.Project(data.Before)
+		old = map[string]interface{}{}
+		for _, key := range changedFields(before, row) {
+			old[key] = canalString(before[key])
+		}
+	}
+	values := make(map[string]interface{}, len(row))
+	for key, value := range row {
+		values[key] = canalString(value)
+	}
+	// 字段类型，计算字段、查询字段、脱敏的字段按 varchar
+	mysqlType, sqlType := map[string]interface{}{}, map[string]interface{}{}
+	columns := map[string]*schema.TableColumn{}
+	if t, err := eventSchema(data); err == nil {
+		for _, field := range schemaFields(projection, nil, t) {
+			columns[field.Key] = field.Column
+		}
+	}
+	for key := range row {
+		if column := columns[key]; column != nil {
+			mysqlType[key] = column.RawType
+			sqlType[key] = javaSqlType(column)
+		} else {
+			mysqlType[key] = "varchar"
+			sqlType[key] = 12
+		}
+	}
+	pkNames := lo.Map(data.PKColumns, func(item string, index int) string {
+		return ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, item)
+	})
+	message := map[string]interface{}{
+		"id":        canalMessageID.Add(1),
+		"database":  db,
+		"table":     table,
+		"pkNames":   pkNames,
+		"isDdl":     false,
+		"type":      strings.ToUpper(data.Action),
+		"es":        src.TsMs,
+		"ts":        time.Now().UnixMilli(),
+		"sql":       "",
+		"sqlType":   sqlType,
+		"mysqlType": mysqlType,
+		"data":      []interface{}{values},
+		"old":       nil,
+	}
+	if old != nil {
+		message["old"] = []interface{}{old}
+	}
+	return message
+}
+
+// MaxwellMessage 包装成 Maxwell 的格式，初始化数据的 type 是 bootstrap-insert
+func MaxwellMessage(data *EventData, projection Projection) map[string]interface{} {
+	src := data.Source
+	if src == nil {
+		src = &EventSource{}
+	}
+	db, table, _ := strings.Cut(data.TableName, ".")
+	message := map[string]interface{}{
+		"database":  db,
+		"table":     table,
+		"type":      data.Action,
+		"ts":        src.TsMs / 1000,
+		"server_id": src.ServerID,
+	}
+	if src.Snapshot {
+		message["type"] = "bootstrap-insert"
+	}
+	if len(src.File) > 0 {
+		message["position"] = src.File + ":" + strconv.FormatUint(uint64(src.Pos), 10)
+	}
+	if len(src.GTID) > 0 {
+		message["gtid"] = src.GTID
+	}
+	if len(data.PKColumns) > 0 {
+		message["primary_key_columns"] = lo.Map(data.PKColumns, func(item string, index int) string {
+			return ConvertColumn(projection.FieldNameFormat, projection.ColumnRename, item)
+		})
+	}
+	switch data.Action {
+	case canal.DeleteAction:
+		message["data"] = projection.Project(data.Before)
+	case canal.UpdateAction:
+		after, before := projection.Project(data.After), projection.Project(data.Before)
+		message["data"] = after
+		message["old"] = lo.SliceToMap(changedFields(before, after), func(key string) (string, interface{}) {
+			return key, before[key]
+		})
+	default:
+		message["data"] = projection.Project(data.After)
+	}
+	return message
+}
+
+// changedFields 修改前后值不同的字段
+func changedFields(before, after map[string]interface{}) []string {
+	var keys []string
+	for key, value := range before {
+		if (value == nil) != (after[key] == nil) || ConvertAnyToString(value) != ConvertAnyToString(after[key]) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// canalString Canal 的值都是字符串，二进制按 ISO-8859-1 转换
+func canalString(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		runes := make([]rune, len(v))
+		for i, b := range v {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case bool:
+		return lo.Ternary(v, "1", "0")
+	}
+	return ConvertAnyToString(value)
+}
+
+// javaSqlType java.sql.Types，和 Canal 的对应关系相同
+func javaSqlType(column *schema.TableColumn) int {
+	rawType := strings.ToLower(column.RawType)
+	for _, item := range []struct {
+		prefix  string
+		sqlType int
+	}{
+		{"tinyint", -6}, {"smallint", 5}, {"mediumint", 4}, {"int", 4}, {"bigint", -5},
+		{"float", 7}, {"double", 8}, {"decimal", 3}, {"bit", -7},
+		{"char", 1}, {"varchar", 12}, {"tinytext", 2005}, {"mediumtext", 2005}, {"longtext", 2005}, {"text", 2005},
+		{"binary", -2}, {"varbinary", -3}, {"tinyblob", 2004}, {"mediumblob", 2004}, {"longblob", 2004}, {"blob", 2004},
+		{"datetime", 93}, {"timestamp", 93}, {"date", 91}, {"time", 92}, {"year", 12},
+		{"enum", 1}, {"set", -7}, {"json", 12},
+	} {
+		if rawType == item.prefix || strings.HasPrefix(rawType, item.prefix+"(") || strings.HasPrefix(rawType, item.prefix+" ") {
+			return item.sqlType
+		}
+	}
+	return 12
+}
@@ -4,17 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	es8 "github.com/elastic/go-elasticsearch/v8"
 	es8api "github.com/elastic/go-elasticsearch/v8/esapi"
-	es8util "github.com/elastic/go-elasticsearch/v8/esutil"
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/schema"
 	"github.com/samber/lo"
 	"io"
 	"log/slog"
-	"runtime"
-	"slices"
 	"strings"
-	"time"
 )
 
 type Elasticsearch8Consumer struct {
@@ -24,23 +22,17 @@ type Elasticsearch8Consumer struct {
 	// 自定义主键
 	CustomPKColumn string `yaml:"customPKColumn" json:"customPKColumn"`
 
-	// 包含的 表格 行 名称。为空，全部行
-	IncludeColumnNames []string `yaml:"includeColumnNames" json:"includeColumnNames"`
-
-	// 排除的 表格 行 名称。为空，全部行
-	ExcludeColumnNames []string `yaml:"excludeColumnNames" json:"excludeColumnNames"`
-
-	// 字段名称格式，小驼峰: lowerCamelCase ，大驼峰：upperCamelCase 其他.不处理
-	FieldNameFormat string `yaml:"fieldNameFormat" json:"fieldNameFormat"`
+	// 同步的字段
+	Projection
 
 	*slog.Logger
 }
 
-func (c *Elasticsearch8Consumer) Accept(data *EventData) {
-	c.BatchAccept([]*EventData{data})
+func (c *Elasticsearch8Consumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
 }
 
-func (c *Elasticsearch8Consumer) BatchAccept(list []*EventData) {
+func (c *Elasticsearch8Consumer) BatchAccept(list []*EventData) error {
 	ids := lo.Map(
 		lo.Filter(list, func(item *EventData, index int) bool {
 			return item.Action == canal.UpdateAction || item.Action == canal.DeleteAction
@@ -50,17 +42,20 @@ func (c *Elasticsearch8Consumer) BatchAccept(list []*EventData) {
 		},
 	)
 	if len(ids) > 0 {
-		c.remove(ids)
+		if err := c.remove(ids); err != nil {
+			return err
+		}
 	}
 	newList := lo.Filter(list, func(item *EventData, index int) bool {
 		return item.Action == canal.UpdateAction || item.Action == canal.InsertAction
 	})
 	if len(newList) > 0 {
-		c.insert(newList)
+		return c.insert(newList)
 	}
+	return nil
 }
 
-func (c *Elasticsearch8Consumer) remove(ids []string) {
+func (c *Elasticsearch8Consumer) remove(ids []string) error {
 	body := map[string]interface{}{
 		"query": map[string]interface{}{
 			"ids": map[string]interface{}{
@@ -73,35 +68,48 @@ func (c *Elasticsearch8Consumer) remove(ids []string) {
 		Index: []string{c.IndexName},
 		Body:  bytes.NewReader(jsonBody),
 	}
-	_, err := req.Do(context.Background(), Es7Client)
+	resp, err := req.Do(context.Background(), Es8Client)
 	if err != nil {
-		slog.Error("elasticsearch 7 remove id", slog.Any("err", err))
+		slog.Error("elasticsearch 8 remove id", slog.Any("err", err))
+		return err
 	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		slog.Error("elasticsearch 8 remove id response", slog.String("status", resp.Status()))
+		return fmt.Errorf("elasticsearch 8 remove id: %s", resp.Status())
+	}
+	return nil
 }
 
-func (c *Elasticsearch8Consumer) insert(list []*EventData) {
+// insert 同步批量写入，有文档失败时返回错误，由磁盘缓冲队列重试
+func (c *Elasticsearch8Consumer) insert(list []*EventData) error {
+	ids := make([]string, 0, len(list))
+	docs := make([][]byte, 0, len(list))
 	for _, item := range list {
-		id := ConvertAnyToString(item.After[c.getPKColumn(item)])
-		newMap := make(map[string]interface{}, len(item.After))
-		b1 := len(c.IncludeColumnNames) > 0
-		b2 := len(c.ExcludeColumnNames) > 0
-		for column, value := range item.After {
-			// 如果 IncludeColumnNames 不包含 字段。或者 ExcludeColumnNames 包含 字段。
-			if b1 && !slices.Contains(c.IncludeColumnNames, column) ||
-				b2 && slices.Contains(c.ExcludeColumnNames, column) {
-				continue
-			} else {
-				newMap[ConvertColumn(c.FieldNameFormat, column)] = value
-			}
-		}
-		buf := ConvertSerializationFormat("json", newMap)
-		doc := es8util.BulkIndexerItem{Action: "index", Index: c.IndexName, DocumentID: id, Body: bytes.NewReader(buf.Bytes())}
-		err := Es8Bi.Add(context.Background(), doc)
-		if err != nil {
-			slog.Info("bulk upsert Add doc fail,", slog.Any("err", err))
-			panic(err)
-		}
+		ids = append(ids, ConvertAnyToString(item.After[c.getPKColumn(item)]))
+		newMap := c.WithSource(c.Project(item.After), item.Source)
+		buf := ConvertSerializationFormat("json", c.DecimalFormat, newMap)
+		docs = append(docs, buf.Bytes())
 	}
+	req := es8api.BulkRequest{
+		Index: c.IndexName,
+		Body:  esBulkBody(c.IndexName, ids, docs),
+	}
+	resp, err := req.Do(context.Background(), Es8Client)
+	if err != nil {
+		slog.Error("elasticsearch 8 bulk index", slog.Any("err", err))
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		slog.Error("elasticsearch 8 bulk index response", slog.String("status", resp.Status()))
+		return esResponseError("elasticsearch 8 bulk index", resp.StatusCode, resp.Status())
+	}
+	if err = esBulkError(resp.Body); err != nil {
+		slog.Error("elasticsearch 8 bulk index fail", slog.Any("err", err))
+		return fmt.Errorf("elasticsearch 8 %w", err)
+	}
+	return nil
 }
 
 // 获取主键ID
@@ -117,27 +125,65 @@ func (c *Elasticsearch8Consumer) getPKColumn(item *EventData) string {
 	}
 }
 
+// UpdateMapping 表结构变化之后，为新的字段添加 mapping
+func (c *Elasticsearch8Consumer) UpdateMapping(table *schema.Table) error {
+	getReq := es8api.IndicesGetMappingRequest{Index: []string{c.IndexName}}
+	resp, err := getReq.Do(context.Background(), Es8Client)
+	if err != nil {
+		slog.Error("elasticsearch 8 get mapping", slog.Any("err", err))
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("elasticsearch 8 get mapping: %s", resp.Status())
+	}
+	var indices map[string]struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&indices); err != nil {
+		return err
+	}
+	properties := esMappingProperties(c.Projection, table, indices[c.IndexName].Mappings.Properties)
+	if len(properties) == 0 {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]interface{}{"properties": properties})
+	putReq := es8api.IndicesPutMappingRequest{
+		Index: []string{c.IndexName},
+		Body:  bytes.NewReader(body),
+	}
+	putResp, err := putReq.Do(context.Background(), Es8Client)
+	if err != nil {
+		slog.Error("elasticsearch 8 put mapping", slog.Any("err", err))
+		return err
+	}
+	defer putResp.Body.Close()
+	if putResp.IsError() {
+		return fmt.Errorf("elasticsearch 8 put mapping: %s", putResp.Status())
+	}
+	slog.Info("elasticsearch 8 put mapping", slog.String("indexName", c.IndexName), slog.Any("properties", lo.Keys(properties)))
+	return nil
+}
+
 // ClearBeforeData 清除之前的数据
 func (c *Elasticsearch8Consumer) ClearBeforeData() {
 	req := es8api.DeleteByQueryRequest{
 		Index: []string{c.IndexName},
 		Body:  strings.NewReader(`{"query": {"match_all": {}}}`),
 	}
-	resp, err := req.Do(context.Background(), Es7Client)
+	resp, err := req.Do(context.Background(), Es8Client)
 	if err != nil {
 		slog.Error("elasticsearch 8 clear before data error", slog.Any("err", err))
-	} else {
-		slog.Info("elasticsearch 8 clear before data success", slog.Any("indexName", c.IndexName))
+		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(resp.Body)
+	defer resp.Body.Close()
 	if resp.IsError() {
-		slog.Error("elasticsearch 8 response ", slog.Any("err", err))
+		slog.Error("elasticsearch 8 clear before data response", slog.String("status", resp.Status()))
+		return
 	}
+	slog.Info("elasticsearch 8 clear before data success", slog.Any("indexName", c.IndexName))
 }
 
 func CreateElasticsearch8Client() {
@@ -174,17 +220,4 @@ func CreateElasticsearch8Client() {
 	}
 	slog.Info("elasticsearch 8", slog.Any("info", info.Status()))
 	Es8Client = esClient
-	flushInterval, err := time.ParseDuration(esConf.FlushInterval)
-	if err != nil {
-		flushInterval = 1 * time.Second
-	}
-	Es8Bi, err = es8util.NewBulkIndexer(es8util.BulkIndexerConfig{
-		Client:        esClient,         // The Elasticsearch client
-		NumWorkers:    runtime.NumCPU(), // The number of worker goroutines
-		FlushInterval: flushInterval,    // The periodic flush interval
-	})
-	if err != nil {
-		slog.Error("elasticsearch 8 indexer error", slog.Any("err", err))
-		panic(err)
-	}
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// esBulkBody 批量写入的请求体，每个文档一行 action 一行 source
+func esBulkBody(indexName string, ids []string, docs [][]byte) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	for i, id := range ids {
+		action, _ := json.Marshal(map[string]interface{}{
+			"index": map[string]interface{}{"_index": indexName, "_id": id},
+		})
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(bytes.TrimSpace(docs[i]))
+		buf.WriteByte('\n')
+	}
+	return buf
+}
+
+// esBulkError 解析批量写入的响应，有文档写入失败时返回错误
+func esBulkError(body io.Reader) error {
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return fmt.Errorf("decode bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	var failed []string
+	permanent := true
+	for _, item := range result.Items {
+		for _, resp := range item {
+			if resp.Error != nil {
+				failed = append(failed, fmt.Sprintf("%s: %d %s %s", resp.ID, resp.Status, resp.Error.Type, resp.Error.Reason))
+				permanent = permanent && esPermanentStatus(resp.Status)
+			}
+		}
+	}
+	err := fmt.Errorf("bulk index failed %d: %s", len(failed), strings.Join(failed, "; "))
+	if permanent {
+		return Permanent(err)
+	}
+	return err
+}
+
+// esPermanentStatus 文档本身的错误，例如 mapping 冲突、文档过大，重试也不会成功。429 是队列满了，可以重试
+func esPermanentStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests &&
+		status != http.StatusRequestTimeout && status != http.StatusUnauthorized && status != http.StatusForbidden
+}
+
+// esResponseError 请求失败的错误，请求本身的错误不再重试
+func esResponseError(prefix string, statusCode int, status string) error {
+	err := fmt.Errorf("%s: %s", prefix, status)
+	if esPermanentStatus(statusCode) {
+		return Permanent(err)
+	}
+	return err
+}
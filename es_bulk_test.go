@@ -0,0 +1,44 @@
+package main
+
+import (
+	es7 "github.com/elastic/go-elasticsearch/v7"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestElasticsearchBulkFailure(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		_, _ = w.Write([]byte(`{"errors":true,"items":[{"index":{"_id":"1","status":429,` +
+			`"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}]}`))
+	}))
+	defer server.Close()
+	client, err := es7.NewClient(es7.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Es7Client = client
+	defer func() { Es7Client = nil }()
+	projection, _ := NewProjection(SyncRule{})
+	consumer := &Elasticsearch7Consumer{IndexName: "t_user", Projection: projection, Logger: slog.Default()}
+	err = consumer.BatchAccept([]*EventData{{
+		Action:    "insert",
+		TableName: "test.t_user",
+		PKColumns: []string{"id"},
+		After:     map[string]interface{}{"id": 1, "name": "a"},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "queue full") {
+		t.Fatalf("bulk failure not returned: %v", err)
+	}
+	if !strings.Contains(body, `"_id":"1"`) || !strings.Contains(body, `"name":"a"`) {
+		t.Errorf("bulk body %s", body)
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter 行过滤表达式，语法是 SQL WHERE 的子集，binlog 和初始化数据的行都按同样的规则计算。也用于计算字段。
+// 支持 AND、OR、NOT、括号、= == != <> < <= > >=、[NOT] IN、[NOT] LIKE、[NOT] BETWEEN、IS [NOT] NULL，
+// 以及函数 concat、lower、upper、trim、ifnull、coalesce
+type Filter struct {
+	// 原始表达式
+	Where string
+	root  filterNode
+}
+
+// tri SQL 的三值逻辑，和 NULL 比较的结果是 unknown
+type tri int8
+
+const (
+	triFalse tri = iota
+	triTrue
+	triUnknown
+)
+
+type filterNode interface {
+	eval(row map[string]interface{}) tri
+}
+
+type filterOperand interface {
+	value(row map[string]interface{}) interface{}
+}
+
+// CompileFilter 解析过滤表达式
+func CompileFilter(where string) (*Filter, error) {
+	tokens, err := tokenizeFilter(where)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("where %q: unexpected %q", where, p.peek().text)
+	}
+	return &Filter{Where: where, root: root}, nil
+}
+
+// Match 行是否满足过滤条件，结果为 unknown 时不满足
+func (f *Filter) Match(row map[string]interface{}) bool {
+	return f.root.eval(row) == triTrue
+}
+
+// Value 计算表达式的值。表达式是单独的字段、值或者函数时返回它的值，否则返回条件的结果，unknown 时返回空
+func (f *Filter) Value(row map[string]interface{}) interface{} {
+	if n, ok := f.root.(valueNode); ok {
+		return n.operand.value(row)
+	}
+	switch f.root.eval(row) {
+	case triTrue:
+		return true
+	case triFalse:
+		return false
+	default:
+		return nil
+	}
+}
+
+type filterTokenKind int8
+
+const (
+	tokenIdent filterTokenKind = iota
+	tokenKeyword
+	tokenNumber
+	tokenString
+	tokenSymbol
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+var filterKeywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true, "IN": true, "IS": true, "NULL": true,
+	"LIKE": true, "BETWEEN": true, "TRUE": true, "FALSE": true,
+}
+
+var filterSymbols = map[string]bool{
+	"=": true, "==": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+	"(": true, ")": true, ",": true, "-": true,
+}
+
+var filterComparisons = map[string]bool{
+	"=": true, "==": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+func tokenizeFilter(where string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(where)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+					sb.WriteRune(runes[j])
+				} else if runes[j] == c {
+					// '' 转义单引号
+					if j+1 < len(runes) && runes[j+1] == c {
+						j++
+						sb.WriteRune(c)
+					} else {
+						break
+					}
+				} else {
+					sb.WriteRune(runes[j])
+				}
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("where %q: unterminated string", where)
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: sb.String()})
+			i = j + 1
+		case c == '`':
+			j := i + 1
+			for j < len(runes) && runes[j] != '`' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("where %q: unterminated identifier", where)
+			}
+			tokens = append(tokens, filterToken{kind: tokenIdent, text: string(runes[i+1 : j])})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: tokenNumber, text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '$') {
+				j++
+			}
+			word := string(runes[i:j])
+			if filterKeywords[strings.ToUpper(word)] {
+				tokens = append(tokens, filterToken{kind: tokenKeyword, text: strings.ToUpper(word)})
+			} else {
+				tokens = append(tokens, filterToken{kind: tokenIdent, text: word})
+			}
+			i = j
+		default:
+			symbol := string(c)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "==" || two == "!=" || two == "<>" || two == "<=" || two == ">=" {
+					symbol = two
+				}
+			}
+			if !filterSymbols[symbol] {
+				return nil, fmt.Errorf("where %q: unexpected %q", where, symbol)
+			}
+			tokens = append(tokens, filterToken{kind: tokenSymbol, text: symbol})
+			i += len([]rune(symbol))
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{kind: tokenSymbol, text: "<end>"}
+	}
+	return p.tokens[p.pos]
+}
+
+// accept 下一个是指定的关键字或者符号时跳过
+func (p *filterParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenKeyword || t.kind == tokenSymbol) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %s, got %q", text, p.peek().text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.accept("NOT") {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parsePredicate() (filterNode, error) {
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("IS") {
+		not := p.accept("NOT")
+		if err = p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		return isNullNode{operand: left, not: not}, nil
+	}
+	not := p.accept("NOT")
+	switch {
+	case p.accept("IN"):
+		if err = p.expect("("); err != nil {
+			return nil, err
+		}
+		node := inNode{operand: left, not: not}
+		for {
+			item, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			node.list = append(node.list, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+		return node, p.expect(")")
+	case p.accept("LIKE"):
+		t := p.peek()
+		if t.kind != tokenString {
+			return nil, fmt.Errorf("LIKE expects a string, got %q", t.text)
+		}
+		p.pos++
+		return likeNode{operand: left, pattern: likePattern(t.text), raw: t.text, not: not}, nil
+	case p.accept("BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenNode{operand: left, low: low, high: high, not: not}, nil
+	case not:
+		return nil, fmt.Errorf("expected IN, LIKE or BETWEEN after NOT, got %q", p.peek().text)
+	}
+	t := p.peek()
+	if t.kind != tokenSymbol || !filterComparisons[t.text] {
+		// 单独的字段或者函数，和 mysql 一样按非 0 判断
+		if !p.done() && t.text != ")" && t.kind != tokenKeyword {
+			return nil, fmt.Errorf("expected comparison, got %q", t.text)
+		}
+		return valueNode{left}, nil
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{left: left, op: t.text, right: right}, nil
+}
+
+func (p *filterParser) parseOperand() (filterOperand, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t.kind == tokenIdent && p.accept("("):
+		return p.parseFunction(t.text)
+	case t.kind == tokenIdent:
+		return columnOperand(t.text), nil
+	case t.kind == tokenString:
+		return literalOperand{t.text}, nil
+	case t.kind == tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return literalOperand{f}, nil
+	case t.kind == tokenSymbol && t.text == "-" && p.peek().kind == tokenNumber:
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return literalOperand{-operand.(literalOperand).v.(float64)}, nil
+	case t.kind == tokenKeyword && t.text == "NULL":
+		return literalOperand{nil}, nil
+	case t.kind == tokenKeyword && t.text == "TRUE":
+		return literalOperand{float64(1)}, nil
+	case t.kind == tokenKeyword && t.text == "FALSE":
+		return literalOperand{float64(0)}, nil
+	}
+	p.pos--
+	return nil, fmt.Errorf("expected column or value, got %q", t.text)
+}
+
+// parseFunction 解析函数的参数，已经读取了左括号
+func (p *filterParser) parseFunction(name string) (filterOperand, error) {
+	fn, ok := filterFunctions[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	node := functionOperand{name: strings.ToLower(name), fn: fn}
+	if p.accept(")") {
+		return node, nil
+	}
+	for {
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		node.args = append(node.args, arg)
+		if !p.accept(",") {
+			break
+		}
+	}
+	return node, p.expect(")")
+}
+
+// filterFunctions 支持的函数，和 mysql 的同名函数一致，参数有 NULL 时结果按 mysql 的规则
+var filterFunctions = map[string]func(args []interface{}) interface{}{
+	"concat": func(args []interface{}) interface{} {
+		var sb strings.Builder
+		for _, arg := range args {
+			if arg == nil {
+				return nil
+			}
+			sb.WriteString(filterString(arg))
+		}
+		return sb.String()
+	},
+	"lower": stringFunction(strings.ToLower),
+	"upper": stringFunction(strings.ToUpper),
+	"trim":  stringFunction(strings.TrimSpace),
+	"ifnull": func(args []interface{}) interface{} {
+		if len(args) != 2 {
+			return nil
+		}
+		if args[0] == nil {
+			return args[1]
+		}
+		return args[0]
+	},
+	"coalesce": func(args []interface{}) interface{} {
+		for _, arg := range args {
+			if arg != nil {
+				return arg
+			}
+		}
+		return nil
+	},
+}
+
+func stringFunction(fn func(string) string) func(args []interface{}) interface{} {
+	return func(args []interface{}) interface{} {
+		if len(args) != 1 || args[0] == nil {
+			return nil
+		}
+		return fn(filterString(args[0]))
+	}
+}
+
+type functionOperand struct {
+	name string
+	fn   func(args []interface{}) interface{}
+	args []filterOperand
+}
+
+func (f functionOperand) value(row map[string]interface{}) interface{} {
+	args := make([]interface{}, len(f.args))
+	for i, arg := range f.args {
+		args[i] = arg.value(row)
+	}
+	return f.fn(args)
+}
+
+type columnOperand string
+
+func (c columnOperand) value(row map[string]interface{}) interface{} {
+	return row[string(c)]
+}
+
+type literalOperand struct {
+	v interface{}
+}
+
+func (l literalOperand) value(map[string]interface{}) interface{} {
+	return l.v
+}
+
+// valueNode 单独的字段或者函数作为条件
+type valueNode struct {
+	operand filterOperand
+}
+
+func (n valueNode) eval(row map[string]interface{}) tri {
+	v := n.operand.value(row)
+	if v == nil {
+		return triUnknown
+	}
+	f, ok := filterNumber(v)
+	return toTri(ok && f != 0)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n orNode) eval(row map[string]interface{}) tri {
+	l, r := n.left.eval(row), n.right.eval(row)
+	if l == triTrue || r == triTrue {
+		return triTrue
+	}
+	if l == triUnknown || r == triUnknown {
+		return triUnknown
+	}
+	return triFalse
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n andNode) eval(row map[string]interface{}) tri {
+	l, r := n.left.eval(row), n.right.eval(row)
+	if l == triFalse || r == triFalse {
+		return triFalse
+	}
+	if l == triUnknown || r == triUnknown {
+		return triUnknown
+	}
+	return triTrue
+}
+
+type notNode struct {
+	node filterNode
+}
+
+func (n notNode) eval(row map[string]interface{}) tri {
+	return negate(n.node.eval(row), true)
+}
+
+// negate not 为 true 时取反，unknown 不变
+func negate(t tri, not bool) tri {
+	if !not || t == triUnknown {
+		return t
+	}
+	if t == triTrue {
+		return triFalse
+	}
+	return triTrue
+}
+
+type compareNode struct {
+	left  filterOperand
+	op    string
+	right filterOperand
+}
+
+func (n compareNode) eval(row map[string]interface{}) tri {
+	c, ok := compareFilterValues(n.left.value(row), n.right.value(row))
+	if !ok {
+		return triUnknown
+	}
+	var result bool
+	switch n.op {
+	case "=", "==":
+		result = c == 0
+	case "!=", "<>":
+		result = c != 0
+	case "<":
+		result = c < 0
+	case "<=":
+		result = c <= 0
+	case ">":
+		result = c > 0
+	case ">=":
+		result = c >= 0
+	}
+	return toTri(result)
+}
+
+type inNode struct {
+	operand filterOperand
+	list    []filterOperand
+	not     bool
+}
+
+func (n inNode) eval(row map[string]interface{}) tri {
+	v := n.operand.value(row)
+	result := triFalse
+	for _, item := range n.list {
+		c, ok := compareFilterValues(v, item.value(row))
+		if !ok {
+			result = triUnknown
+		} else if c == 0 {
+			result = triTrue
+			break
+		}
+	}
+	return negate(result, n.not)
+}
+
+type betweenNode struct {
+	operand   filterOperand
+	low, high filterOperand
+	not       bool
+}
+
+func (n betweenNode) eval(row map[string]interface{}) tri {
+	v := n.operand.value(row)
+	low, ok1 := compareFilterValues(v, n.low.value(row))
+	high, ok2 := compareFilterValues(v, n.high.value(row))
+	if !ok1 || !ok2 {
+		return triUnknown
+	}
+	return negate(toTri(low >= 0 && high <= 0), n.not)
+}
+
+type isNullNode struct {
+	operand filterOperand
+	not     bool
+}
+
+func (n isNullNode) eval(row map[string]interface{}) tri {
+	return negate(toTri(n.operand.value(row) == nil), n.not)
+}
+
+type likeNode struct {
+	operand filterOperand
+	pattern *regexp.Regexp
+	// 原始的 LIKE 模式
+	raw string
+	not bool
+}
+
+func (n likeNode) eval(row map[string]interface{}) tri {
+	v := n.operand.value(row)
+	if v == nil {
+		return triUnknown
+	}
+	return negate(toTri(n.pattern.MatchString(filterString(v))), n.not)
+}
+
+// likePattern LIKE 的 % _ 转成正则表达式
+func likePattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile("(?s)" + sb.String())
+}
+
+func toTri(b bool) tri {
+	if b {
+		return triTrue
+	}
+	return triFalse
+}
+
+// compareFilterValues 两边都能转成数字时按数字比较，否则按字符串比较。有一边是 NULL 时无法比较
+func compareFilterValues(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	fa, okA := filterNumber(a)
+	fb, okB := filterNumber(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+	return strings.Compare(filterString(a), filterString(b)), true
+}
+
+func filterNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case decimal.Decimal:
+		f, _ := n.Float64()
+		return f, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string, []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(filterString(v)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func filterString(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		return t.Format("2006-01-02 15:04:05.999999")
+	}
+	return ConvertAnyToString(v)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/samber/lo"
+	"strconv"
+	"strings"
+)
+
+// SQL 把过滤表达式中可以交给 mysql 的部分转成 WHERE 条件，初始化数据时减少读取的行，结果仍然按 Match 过滤。
+// 只转换和 Match 一致或者更宽松的条件: 整数、DECIMAL 字段和数字比较，字符串字段 = IN LIKE 非数字的字符串，
+// IS [NOT] NULL；函数、NOT、时间字段等不转换。没有可以转换的条件时返回空
+func (f *Filter) SQL(table *schema.Table) (string, []interface{}) {
+	w := &filterSQL{table: table}
+	if !w.node(f.root) {
+		return "", nil
+	}
+	return w.sb.String(), w.args
+}
+
+type filterSQL struct {
+	table *schema.Table
+	sb    strings.Builder
+	args  []interface{}
+}
+
+// node 写入节点的条件，无法转换时返回 false，不写入
+func (w *filterSQL) node(node filterNode) bool {
+	switch n := node.(type) {
+	case andNode:
+		// AND 可以只保留能转换的一边
+		left := &filterSQL{table: w.table}
+		right := &filterSQL{table: w.table}
+		okLeft, okRight := left.node(n.left), right.node(n.right)
+		switch {
+		case okLeft && okRight:
+			w.write("("+left.sb.String()+" AND "+right.sb.String()+")", append(left.args, right.args...)...)
+		case okLeft:
+			w.write(left.sb.String(), left.args...)
+		case okRight:
+			w.write(right.sb.String(), right.args...)
+		}
+		return okLeft || okRight
+	case orNode:
+		// OR 两边都能转换才能转换
+		left := &filterSQL{table: w.table}
+		right := &filterSQL{table: w.table}
+		if !left.node(n.left) || !right.node(n.right) {
+			return false
+		}
+		w.write("("+left.sb.String()+" OR "+right.sb.String()+")", append(left.args, right.args...)...)
+		return true
+	case isNullNode:
+		column := w.column(n.operand)
+		// 零值日期转换成空，和 mysql 的 IS NULL 不一致
+		if column == nil || isTemporalColumn(column) {
+			return false
+		}
+		w.write(quoteIdentifier(column.Name) + lo.Ternary(n.not, " IS NOT NULL", " IS NULL"))
+		return true
+	case compareNode:
+		column, literal, op := w.column(n.left), n.right, n.op
+		if column == nil {
+			// 值在左边时交换
+			column, literal, op = w.column(n.right), n.left, flipComparison(n.op)
+		}
+		value, ok := literal.(literalOperand)
+		if column == nil || !ok || !w.comparable(column, value.v, op) {
+			return false
+		}
+		w.write(quoteIdentifier(column.Name)+" "+sqlComparison(op)+" ?", value.v)
+		return true
+	case inNode:
+		column := w.column(n.operand)
+		if column == nil || len(n.list) == 0 {
+			return false
+		}
+		var args []interface{}
+		for _, item := range n.list {
+			value, ok := item.(literalOperand)
+			if !ok || !w.comparable(column, value.v, lo.Ternary(n.not, "!=", "=")) {
+				return false
+			}
+			args = append(args, value.v)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+		w.write(quoteIdentifier(column.Name)+lo.Ternary(n.not, " NOT IN (", " IN (")+placeholders+")", args...)
+		return true
+	case betweenNode:
+		column := w.column(n.operand)
+		low, okLow := n.low.(literalOperand)
+		high, okHigh := n.high.(literalOperand)
+		if column == nil || !okLow || !okHigh || !isNumericColumn(column) ||
+			!safeNumber(low.v) || !safeNumber(high.v) {
+			return false
+		}
+		w.write(quoteIdentifier(column.Name)+lo.Ternary(n.not, " NOT BETWEEN ? AND ?", " BETWEEN ? AND ?"), low.v, high.v)
+		return true
+	case likeNode:
+		column := w.column(n.operand)
+		// mysql 的 LIKE 中 \ 是转义字符
+		if column == nil || n.not || column.Type != schema.TYPE_STRING || strings.Contains(n.raw, "\\") {
+			return false
+		}
+		w.write(quoteIdentifier(column.Name)+" LIKE ?", n.raw)
+		return true
+	}
+	return false
+}
+
+func (w *filterSQL) write(sql string, args ...interface{}) {
+	w.sb.WriteString(sql)
+	w.args = append(w.args, args...)
+}
+
+// column 操作数是表中的字段时返回字段
+func (w *filterSQL) column(operand filterOperand) *schema.TableColumn {
+	name, ok := operand.(columnOperand)
+	if !ok || w.table == nil {
+		return nil
+	}
+	for i := range w.table.Columns {
+		if w.table.Columns[i].Name == string(name) {
+			return &w.table.Columns[i]
+		}
+	}
+	return nil
+}
+
+// comparable 字段和值的比较在 mysql 中的结果和 Match 一致或者更宽松。
+// 数字字段只和数字比较；字符串字段只用 = 和不像数字的字符串比较，Match 会把两个数字字符串按数字比较，
+// mysql 的排序规则可能不区分大小写，结果更宽松
+func (w *filterSQL) comparable(column *schema.TableColumn, value interface{}, op string) bool {
+	if isNumericColumn(column) {
+		return safeNumber(value)
+	}
+	s, ok := value.(string)
+	if !ok || (column.Type != schema.TYPE_STRING && column.Type != schema.TYPE_ENUM) || (op != "=" && op != "==") {
+		return false
+	}
+	_, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return err != nil
+}
+
+func isNumericColumn(column *schema.TableColumn) bool {
+	switch column.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT, schema.TYPE_DECIMAL:
+		return true
+	}
+	return false
+}
+
+func isTemporalColumn(column *schema.TableColumn) bool {
+	switch column.Type {
+	case schema.TYPE_DATE, schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_TIME:
+		return true
+	}
+	return false
+}
+
+// filterMaxSafeInteger Match 按 float64 比较数字，超过的整数有误差
+const filterMaxSafeInteger = 1 << 53
+
+// safeNumber 数字的值，并且 Match 可以精确比较
+func safeNumber(value interface{}) bool {
+	f, ok := value.(float64)
+	return ok && f > -filterMaxSafeInteger && f < filterMaxSafeInteger
+}
+
+// flipComparison 交换比较的两边
+func flipComparison(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return op
+}
+
+func sqlComparison(op string) string {
+	switch op {
+	case "==":
+		return "="
+	case "!=":
+		return "<>"
+	}
+	return op
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/schema"
+	"reflect"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	row := map[string]interface{}{
+		"status":    int8(1),
+		"tenant_id": int64(5),
+		"name":      "molly",
+		"price":     "12.50",
+		"deleted":   nil,
+	}
+	cases := map[string]bool{
+		"status = 1 AND tenant_id IN (3,5)":         true,
+		"status = 1 AND tenant_id NOT IN (3,5)":     false,
+		"status != 1 OR name LIKE 'mol%'":           true,
+		"NOT (price > 12.5)":                        true,
+		"price BETWEEN 10 AND 20":                   true,
+		"deleted IS NULL AND `name` = 'molly'":      true,
+		"deleted = 1":                               false,
+		"NOT deleted = 1":                           false,
+		"tenant_id >= -1 AND name <> 'it''s'":       true,
+		"deleted IS NOT NULL OR tenant_id IN (1,2)": false,
+	}
+	for where, want := range cases {
+		f, err := CompileFilter(where)
+		if err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+		if got := f.Match(row); got != want {
+			t.Errorf("%s: got %v, want %v", where, got, want)
+		}
+	}
+	for _, where := range []string{"status =", "status = 1 AND", "(status = 1", "status ! 1", "status NOT 1"} {
+		if _, err := CompileFilter(where); err == nil {
+			t.Errorf("%s: expected error", where)
+		}
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "t_user"}
+	table.AddColumn("id", "bigint", "", "")
+	table.AddColumn("status", "tinyint", "", "")
+	table.AddColumn("name", "varchar(32)", "", "")
+	table.AddColumn("created_at", "datetime", "", "")
+	cases := []struct {
+		where string
+		sql   string
+		args  []interface{}
+	}{
+		{"status = 1 AND name = 'tom'", "(`status` = ? AND `name` = ?)", []interface{}{float64(1), "tom"}},
+		{"status IN (1, 2) OR id BETWEEN 5 AND 9", "(`status` IN (?, ?) OR `id` BETWEEN ? AND ?)",
+			[]interface{}{float64(1), float64(2), float64(5), float64(9)}},
+		// 只转换 AND 中可以转换的一边
+		{"name != 'a' AND 10 < id", "`id` > ?", []interface{}{float64(10)}},
+		{"name LIKE 'mo%' AND name IS NOT NULL", "(`name` LIKE ? AND `name` IS NOT NULL)", []interface{}{"mo%"}},
+		// 函数、NOT、数字字符串、时间字段不转换
+		{"status = 1 OR lower(name) = 'a'", "", nil},
+		{"NOT (status = 1)", "", nil},
+		{"name = '12'", "", nil},
+		{"created_at IS NULL", "", nil},
+	}
+	for _, c := range cases {
+		filter, err := CompileFilter(c.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sql, args := filter.SQL(table)
+		if sql != c.sql || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: got %q %v, want %q %v", c.where, sql, args, c.sql, c.args)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
 	"github.com/go-mysql-org/go-mysql/schema"
-	"regexp"
+	"slices"
 )
 
 type EventData struct {
@@ -18,54 +20,184 @@ type EventData struct {
 	Before map[string]interface{}
 	// 执行动作之后
 	After map[string]interface{}
-}
-
-type EventRule struct {
-	// 正则表达式
-	Reg *regexp.Regexp
-	// 管道
-	Stream chan *EventData
+	// 表结构变化，Action 为 ddl 时不为空
+	DDL *DDLEvent
+	// 事件的来源
+	Source *EventSource
+	// 事件位置的表结构，canal、maxwell 的字段类型按这个结构输出，为空时查询当前的结构。
+	// 写入缓冲队列时一起保存，死信文件中不输出
+	Schema *schema.Table `json:"-"`
 }
 
 type MyEventHandler struct {
 	canal.DummyEventHandler
-	Rules []EventRule
+	// OnDDL 之前 OnTableChanged 收到的表
+	changedTables [][2]string
+	// 当前的 binlog 文件，和事件的位置一起查询表结构历史
+	binlogFile string
+	// 当前事务的 GTID
+	gtid string
+	// 当前事务的编号，事务提交之后清空
+	txID string
+}
+
+func (h *MyEventHandler) OnGTID(header *replication.EventHeader, gtidEvent mysql.BinlogGTIDEvent) error {
+	h.gtid, h.txID = "", ""
+	if set, err := gtidEvent.GTIDNext(); err == nil {
+		h.gtid = set.String()
+	}
+	return nil
+}
+
+// OnXID 事务提交
+func (h *MyEventHandler) OnXID(header *replication.EventHeader, nextPos mysql.Position) error {
+	h.txID = ""
+	return nil
+}
+
+func (h *MyEventHandler) OnRotate(header *replication.EventHeader, rotateEvent *replication.RotateEvent) error {
+	h.binlogFile = string(rotateEvent.NextLogName)
+	return nil
 }
 
 func (h *MyEventHandler) OnRow(e *canal.RowsEvent) error {
 	fullTableName := fmt.Sprintf("%s.%s", e.Table.Schema, e.Table.Name)
-	for _, rule := range h.Rules {
-		ms := rule.Reg.MatchString(fullTableName)
-		if ms {
-			data := &EventData{
-				Action:    e.Action,
-				TableName: fullTableName,
-				PKColumns: getPKColumns(e.Table),
+	// canal 使用当前的表结构，从之前的位置同步时按当时的结构解析
+	table := e.Table
+	if e.Header != nil {
+		table = SchemaAt(mysql.Position{Name: h.binlogFile, Pos: e.Header.LogPos}, e.Table)
+	}
+	pkColumns := getPKColumns(table)
+	var source *EventSource
+	if e.Header != nil {
+		// 事务的编号: GTID，没有开启 GTID 时是事务中第一个行事件的位置
+		if len(h.txID) == 0 {
+			h.txID = h.gtid
+			if len(h.txID) == 0 {
+				h.txID = fmt.Sprintf("%s:%d", h.binlogFile, e.Header.LogPos-e.Header.EventSize)
 			}
-			switch e.Action {
-			case canal.UpdateAction:
-				data.Before = anyToObj(e.Rows[0], e.Table)
-				data.After = anyToObj(e.Rows[1], e.Table)
-				break
-			case canal.InsertAction:
-				data.After = anyToObj(e.Rows[0], e.Table)
-				break
-			case canal.DeleteAction:
-				data.Before = anyToObj(e.Rows[0], e.Table)
-			default:
-				break
+		}
+		source = &EventSource{
+			File:     h.binlogFile,
+			Pos:      e.Header.LogPos,
+			GTID:     h.gtid,
+			ServerID: e.Header.ServerID,
+			TsMs:     int64(e.Header.Timestamp) * 1000,
+			TxID:     h.txID,
+		}
+	}
+	// 一个事件可能包含多行，更新事件每两行是一对 before、after
+	var list []*EventData
+	step := 1
+	if e.Action == canal.UpdateAction {
+		step = 2
+	}
+	for i := 0; i+step <= len(e.Rows); i += step {
+		data := &EventData{
+			Action:    e.Action,
+			TableName: fullTableName,
+			PKColumns: pkColumns,
+			Source:    source,
+			Schema:    table,
+		}
+		switch e.Action {
+		case canal.UpdateAction:
+			data.Before = anyToObj(e.Rows[i], table)
+			data.After = anyToObj(e.Rows[i+1], table)
+		case canal.InsertAction:
+			data.After = anyToObj(e.Rows[i], table)
+		case canal.DeleteAction:
+			data.Before = anyToObj(e.Rows[i], table)
+		}
+		list = append(list, data)
+	}
+	eventsReceived.WithLabelValues(fullTableName, e.Action).Add(float64(len(list)))
+	// 规则查询的表变化时失效缓存
+	InvalidateLookups(fullTableName, list)
+	// 热加载替换规则时，等待当前事件写入完成
+	rulesSwapMu.RLock()
+	defer rulesSwapMu.RUnlock()
+	for _, rule := range ActiveRules() {
+		if !rule.Reg.MatchString(fullTableName) {
+			continue
+		}
+		for _, data := range list {
+			if matched := rule.Match(data); matched != nil {
+				rule.Push(matched)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *MyEventHandler) OnTableChanged(header *replication.EventHeader, schema string, table string) error {
+	h.changedTables = append(h.changedTables, [2]string{schema, table})
+	return nil
+}
+
+// OnDDL 按顺序写入匹配的规则，和之前的行事件一起处理
+func (h *MyEventHandler) OnDDL(header *replication.EventHeader, nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	tables := h.changedTables
+	h.changedTables, h.txID = nil, ""
+	ddlType := ParseDDLType(string(queryEvent.Query))
+	// 按 DDL 语句记录之后的结构，无法计算时才使用 canal 刷新之后的表结构
+	pos := mysql.Position{Name: h.binlogFile, Pos: nextPos.Pos}
+	recorded := RecordDDL(pos, string(queryEvent.Schema), string(queryEvent.Query))
+	if mysqlCanal != nil {
+		for _, table := range tables {
+			if slices.Contains(recorded, table[0]+"."+table[1]) || ddlType == DDLDrop {
+				continue
 			}
-			rule.Stream <- data
+			// 删除的表没有结构
+			if t, err := mysqlCanal.GetTable(table[0], table[1]); err == nil {
+				RecordSchema(pos, t)
+			}
+		}
+	}
+	rulesSwapMu.RLock()
+	defer rulesSwapMu.RUnlock()
+	for _, table := range tables {
+		fullTableName := fmt.Sprintf("%s.%s", table[0], table[1])
+		// DDL 之后的表结构，删除的表没有结构
+		var tableSchema *schema.Table
+		if latest := latestSchema(fullTableName); latest != nil && ddlType != DDLDrop {
+			tableSchema = SchemaAt(pos, latest)
+		}
+		for _, rule := range ActiveRules() {
+			if !rule.Reg.MatchString(fullTableName) {
+				continue
+			}
+			rule.Push(&EventData{
+				Action:    DDLAction,
+				TableName: fullTableName,
+				Schema:    tableSchema,
+				DDL: &DDLEvent{
+					Type:   ddlType,
+					Schema: table[0],
+					Table:  table[1],
+					Query:  string(queryEvent.Query),
+				},
+			})
 		}
 	}
 	return nil
 }
 
+func (h *MyEventHandler) OnPosSynced(header *replication.EventHeader, pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	// 从 GTID 开始同步时，收到 rotate 事件之前没有文件名
+	if len(pos.Name) == 0 {
+		return nil
+	}
+	SetBinlogPosition(pos.Name, pos.Pos)
+	RecordPosition(pos)
+	return nil
+}
+
 func anyToObj(row []interface{}, table *schema.Table) map[string]interface{} {
 	obj := make(map[string]interface{}, len(row))
-	for i, column := range table.Columns {
+	for i := range table.Columns {
 		if i < len(row) {
-			obj[column.Name] = row[i]
+			obj[table.Columns[i].Name] = ConvertColumnValue(&table.Columns[i], row[i])
 		}
 	}
 	return obj
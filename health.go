@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// binlog 同步是否在运行
+	binlogRunning atomic.Bool
+	// 初始化数据是否完成
+	snapshotDone atomic.Bool
+)
+
+// ReadyCheck 就绪检查的结果
+type ReadyCheck struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthz 进程存活
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readyz binlog 已连接、sink 可访问、初始化数据已完成、延迟低于阈值，才算就绪
+func readyz(w http.ResponseWriter, r *http.Request) {
+	result := CheckReady(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if result.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("readyz encode", slog.Any("err", err))
+	}
+}
+
+// CheckReady 执行所有的就绪检查
+func CheckReady(ctx context.Context) ReadyCheck {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result := ReadyCheck{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			result.Ready = false
+			result.Checks[name] = err.Error()
+		} else {
+			result.Checks[name] = "ok"
+		}
+	}
+	check("snapshot", checkSnapshot())
+	check("binlog", checkBinlog())
+	if RedisClient != nil {
+		check("redis", RedisClient.Ping(ctx).Err())
+	}
+	if Es7Client != nil {
+		check("es7", checkElasticsearch7(ctx))
+	}
+	if Es8Client != nil {
+		check("es8", checkElasticsearch8(ctx))
+	}
+	return result
+}
+
+func checkSnapshot() error {
+	if !snapshotDone.Load() {
+		return fmt.Errorf("initial snapshot in progress")
+	}
+	return nil
+}
+
+func checkBinlog() error {
+	c := CurrentCanal()
+	if c == nil || !binlogRunning.Load() || c.Ctx().Err() != nil {
+		return fmt.Errorf("binlog stream not running")
+	}
+	maxLag := Config.Health.MaxLagSeconds
+	if delay := c.GetDelay(); maxLag > 0 && delay > maxLag {
+		return fmt.Errorf("binlog lag %ds exceeds %ds", delay, maxLag)
+	}
+	return nil
+}
+
+func checkElasticsearch7(ctx context.Context) error {
+	resp, err := Es7Client.Info(Es7Client.Info.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("elasticsearch 7 info: %s", resp.Status())
+	}
+	return nil
+}
+
+func checkElasticsearch8(ctx context.Context) error {
+	resp, err := Es8Client.Info(Es8Client.Info.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("elasticsearch 8 info: %s", resp.Status())
+	}
+	return nil
+}
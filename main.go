@@ -1,31 +1,73 @@
 package main
 
 import (
+	"fmt"
 	es7 "github.com/elastic/go-elasticsearch/v7"
-	es7util "github.com/elastic/go-elasticsearch/v7/esutil"
 	es8 "github.com/elastic/go-elasticsearch/v8"
-	es8util "github.com/elastic/go-elasticsearch/v8/esutil"
 	"github.com/go-mysql-org/go-mysql/canal"
 	gomysql "github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
 	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	RedisClient       redis.UniversalClient
 	Es7Client         *es7.Client
-	Es7Bi             es7util.BulkIndexer
 	Es8Client         *es8.Client
-	Es8Bi             es8util.BulkIndexer
 	mysqlPosition     gomysql.Position
 	includeTableRegex []string
-	eventRules        []EventRule
+	mysqlCanal        *canal.Canal
+	mysqlDB           *gorm.DB
+	snapshotDB        *gorm.DB
+	mysqlGTIDSet      string
+	canalMu           sync.Mutex
+	canalRestarting   atomic.Bool
+	canalRestart      = make(chan gomysql.Position)
 )
 
 func main() {
+	// 导出 typedProtobuf 的 proto 文件: molly-mysql-canal proto [目录]
+	if len(os.Args) > 1 && os.Args[1] == "proto" {
+		dir := "./proto"
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		if err := ExportProto(dir); err != nil {
+			slog.Error("export proto", slog.Any("err", err))
+			os.Exit(1)
+		}
+		return
+	}
 	mysqlCfg := Config.Mysql
+	// 启动 http 服务
+	StartHttpServer()
 	// 初始化 规则
 	InitRules(mysqlCfg)
+	snapshotDone.Store(true)
+	// 热加载 规则
+	WatchRules()
+	// 定时保存 binlog 位置
+	StartCheckpointer()
+	for {
+		RunCanal(mysqlCfg)
+		// 通过管理接口修改了 binlog 位置，从新的位置重新开始
+		if !canalRestarting.Load() {
+			return
+		}
+		mysqlPosition = <-canalRestart
+		mysqlGTIDSet = ""
+		ResetCheckpoint(mysqlPosition)
+		slog.Info("restart canal", slog.Any("position", mysqlPosition))
+	}
+}
+
+// RunCanal 从 mysqlPosition 开始同步 binlog，直到出错或者关闭
+func RunCanal(mysqlCfg MysqlConfig) {
 	cfg := canal.NewDefaultConfig()
 	// CREATE USER canal IDENTIFIED BY 'canal';
 	// GRANT RELOAD,SELECT, REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO IDENTIFIED BY 'canal' WITH GRANT OPTION;
@@ -37,24 +79,105 @@ func main() {
 	cfg.Password = mysqlCfg.Password
 	cfg.Logger = SlogAdapter{Adapter: slog.Default()}
 	cfg.Dump.ExecutionPath = ""
-	if len(includeTableRegex) > 0 {
+	// DECIMAL 解析成 decimal.Decimal，不丢失精度
+	cfg.UseDecimal = true
+	// TIMESTAMP 按 UTC 格式化，和初始化数据的连接相同
+	cfg.TimestampStringLocation = time.UTC
+	// 开启规则热加载时，新增的规则可能匹配任意表，不过滤
+	if len(includeTableRegex) > 0 && !Config.ReloadRules {
 		cfg.IncludeTableRegex = includeTableRegex
 	}
+	canalMu.Lock()
 	c, err := canal.NewCanal(cfg)
+	canalRestarting.Store(false)
 	if err != nil {
+		canalMu.Unlock()
 		slog.Error("new canal error", slog.Any("err", err))
+		return
 	}
+	mysqlCanal = c
+	canalMu.Unlock()
 	slog.Info("canal table", slog.Any("includeTableRegex", includeTableRegex))
-	c.SetEventHandler(&MyEventHandler{Rules: eventRules})
-	if err = c.RunFrom(mysqlPosition); err != nil {
+	c.SetEventHandler(&MyEventHandler{})
+	binlogRunning.Store(true)
+	if len(mysqlPosition.Name) == 0 && len(mysqlGTIDSet) > 0 {
+		// 从库初始化数据之后，从从库快照的 GTID 集合开始同步主库
+		var set gomysql.GTIDSet
+		if set, err = gomysql.ParseGTIDSet(gomysql.MySQLFlavor, mysqlGTIDSet); err == nil {
+			slog.Info("start canal from gtid", slog.String("gtidSet", mysqlGTIDSet))
+			err = c.StartFromGTID(set)
+		}
+	} else {
+		err = c.RunFrom(mysqlPosition)
+	}
+	if err != nil {
 		slog.Error("start canal error", slog.Any("err", err))
 	}
+	binlogRunning.Store(false)
 }
 
-func direct(c1 Consumer, ch chan *EventData) {
+// CurrentCanal 当前的 binlog 同步，重新开始同步时会替换
+func CurrentCanal() *canal.Canal {
+	canalMu.Lock()
+	defer canalMu.Unlock()
+	return mysqlCanal
+}
+
+// RestartCanal 停止 binlog 同步，从新的位置重新开始
+func RestartCanal(pos gomysql.Position) error {
+	canalMu.Lock()
+	defer canalMu.Unlock()
+	if mysqlCanal == nil || !binlogRunning.Load() {
+		return fmt.Errorf("binlog stream not running")
+	}
+	if !canalRestarting.CompareAndSwap(false, true) {
+		return fmt.Errorf("canal is restarting")
+	}
+	mysqlCanal.Close()
+	canalRestart <- pos
+	return nil
+}
+
+func direct(rule *EventRule) {
+	if rule.Spool != nil {
+		retryInterval, err := time.ParseDuration(Config.Spool.RetryInterval)
+		if err != nil {
+			retryInterval = 3 * time.Second
+		}
+		runWithSpool(rule, retryInterval)
+		return
+	}
+	// 暂停时事件写入临时的缓冲队列，避免管道写满阻塞 binlog 和其他规则
+	buffer := &pauseBuffer{rule: rule}
+	defer buffer.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		if d1, ok := <-ch; ok {
-			c1.Accept(d1)
+		select {
+		case d1 := <-rule.Stream:
+			if rule.Paused() && buffer.Push(d1) {
+				continue
+			}
+			buffer.Drain()
+			deliverDirect(rule, d1)
+		case <-ticker.C:
+			if !rule.Paused() {
+				buffer.Drain()
+			}
+		case <-rule.stopCh:
+			buffer.Drain()
+			for n := len(rule.Stream); n > 0; n-- {
+				deliverDirect(rule, <-rule.Stream)
+			}
+			return
 		}
 	}
 }
+
+// deliverDirect 没有磁盘缓冲队列时，写入失败的事件记录到死信文件，不阻塞之后的事件
+func deliverDirect(rule *EventRule, data *EventData) {
+	if err := rule.Consumer.Accept(data); err != nil {
+		WriteDeadLetter(rule.Name, data, err)
+	}
+	rule.done.Add(1)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+const metricsNamespace = "molly_canal"
+
+var (
+	// 收到的 binlog 事件数量
+	eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "Number of row events received from the binlog.",
+	}, []string{"table", "action"})
+
+	// 关注的字段没有变化，跳过的更新事件数量
+	eventsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_skipped_total",
+		Help:      "Number of update events skipped because no watched column changed.",
+	}, []string{"rule"})
+
+	// 写入死信文件的事件数量
+	eventsDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_dead_lettered_total",
+		Help:      "Number of events written to the dead-letter file.",
+	}, []string{"rule"})
+
+	// 写入 sink 成功的事件数量
+	eventsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_delivered_total",
+		Help:      "Number of events delivered to the sink.",
+	}, []string{"rule", "target"})
+
+	// 写入 sink 失败的事件数量
+	eventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_failed_total",
+		Help:      "Number of events the sink failed to accept.",
+	}, []string{"rule", "target"})
+
+	// 每批写入 sink 的事件数量
+	batchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_size",
+		Help:      "Number of events per sink write.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"rule", "target"})
+
+	// 写入 sink 的耗时
+	sinkLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_latency_seconds",
+		Help:      "Latency of sink writes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"rule", "target"})
+
+	// 初始化数据的总行数
+	snapshotRowsTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_rows_total",
+		Help:      "Number of rows to copy by the initial snapshot.",
+	}, []string{"table"})
+
+	// 初始化数据已完成的行数
+	snapshotRowsDone = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_rows_done",
+		Help:      "Number of rows copied by the initial snapshot.",
+	}, []string{"table"})
+
+	// 当前 binlog 位置
+	binlogPosition = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "binlog_position",
+		Help:      "Current synced binlog position, labeled by binlog file.",
+	}, []string{"file"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "replication_delay_seconds",
+		Help:      "Seconds behind master of the binlog stream.",
+	}, func() float64 {
+		c := CurrentCanal()
+		if c == nil {
+			return 0
+		}
+		return float64(c.GetDelay())
+	})
+}
+
+// RegisterRuleMetrics 注册规则的管道深度、磁盘缓冲队列，返回的指标在规则停止时注销
+func RegisterRuleMetrics(rule *EventRule) []prometheus.Collector {
+	labels := prometheus.Labels{"rule": rule.Name}
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "queue_depth",
+			Help:        "Number of events waiting in the rule stream.",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(len(rule.Stream))
+		}),
+	}
+	if rule.Spool != nil {
+		collectors = append(collectors,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "spool_events",
+				Help:        "Number of events waiting in the on-disk spool.",
+				ConstLabels: labels,
+			}, func() float64 {
+				return float64(rule.Spool.Len())
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "spool_bytes",
+				Help:        "Size of the on-disk spool segments.",
+				ConstLabels: labels,
+			}, func() float64 {
+				return float64(rule.Spool.Size())
+			}),
+		)
+	}
+	for _, collector := range collectors {
+		prometheus.MustRegister(collector)
+	}
+	return collectors
+}
+
+// UnregisterRuleMetrics 注销规则的指标
+func UnregisterRuleMetrics(collectors []prometheus.Collector) {
+	for _, collector := range collectors {
+		prometheus.Unregister(collector)
+	}
+}
+
+// SetBinlogPosition 记录当前 binlog 位置
+func SetBinlogPosition(file string, pos uint32) {
+	binlogPosition.Reset()
+	binlogPosition.WithLabelValues(file).Set(float64(pos))
+}
+
+// MetricsConsumer 统计 sink 的写入数量、批次大小、耗时
+type MetricsConsumer struct {
+	Consumer
+
+	// 所属的规则
+	Rule *EventRule
+}
+
+func (c *MetricsConsumer) Accept(data *EventData) error {
+	return c.observe(1, func() error {
+		return c.Consumer.Accept(data)
+	})
+}
+
+func (c *MetricsConsumer) BatchAccept(list []*EventData) error {
+	return c.observe(len(list), func() error {
+		return c.Consumer.BatchAccept(list)
+	})
+}
+
+func (c *MetricsConsumer) observe(n int, fn func() error) error {
+	name, target := c.Rule.Name, c.Rule.Target()
+	start := time.Now()
+	err := fn()
+	sinkLatency.WithLabelValues(name, target).Observe(time.Since(start).Seconds())
+	batchSize.WithLabelValues(name, target).Observe(float64(n))
+	if err != nil {
+		eventsFailed.WithLabelValues(name, target).Add(float64(n))
+		c.Rule.failed.Add(uint64(n))
+	} else {
+		eventsDelivered.WithLabelValues(name, target).Add(float64(n))
+		c.Rule.delivered.Add(uint64(n))
+	}
+	return err
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"fmt"
-	"github.com/go-mysql-org/go-mysql/canal"
 	gomysql "github.com/go-mysql-org/go-mysql/mysql"
 	slogGorm "github.com/orandin/slog-gorm"
 	"github.com/samber/lo"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"log/slog"
+	"path/filepath"
 	"regexp"
 	"slices"
-	"strings"
+	"time"
 )
 
 type MySqlPosition struct {
@@ -20,190 +20,183 @@ type MySqlPosition struct {
 }
 
 func InitRules(mysqlCfg MysqlConfig) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		mysqlCfg.Username, mysqlCfg.Password, mysqlCfg.Addr, "information_schema")
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: slogGorm.New()})
+	if err := LoadTemporalConfig(); err != nil {
+		slog.Error("load temporal config ", slog.Any("error", err))
+		panic(err)
+	}
+	db, err := OpenMysql(mysqlCfg.Addr, mysqlCfg.Username, mysqlCfg.Password)
 	if err != nil {
 		slog.Error("connect mysql ", slog.Any("error", err))
 		panic(err)
 	}
+	mysqlDB = db
 	slog.Info("connect mysql server success")
-	var mp MySqlPosition
-	err = db.Raw("SHOW MASTER STATUS;").Scan(&mp).Error
+	// 初始化数据读取从库，binlog 仍然读取主库
+	snapshotDB = db
+	if len(mysqlCfg.SnapshotAddr) > 0 {
+		snapshotDB, err = OpenMysql(mysqlCfg.SnapshotAddr,
+			lo.Ternary(len(mysqlCfg.SnapshotUsername) > 0, mysqlCfg.SnapshotUsername, mysqlCfg.Username),
+			lo.Ternary(len(mysqlCfg.SnapshotPassword) > 0, mysqlCfg.SnapshotPassword, mysqlCfg.Password))
+		if err != nil {
+			slog.Error("connect snapshot mysql ", slog.Any("error", err))
+			panic(err)
+		}
+		slog.Info("connect snapshot mysql server success", slog.String("addr", mysqlCfg.SnapshotAddr))
+	}
+	// 数据目录中保存了 binlog 位置，从上次的位置继续
+	resumed, err := LoadSyncState()
 	if err != nil {
-		slog.Error("execute mysql `show master status` ", slog.Any("error", err))
+		slog.Error("load sync state ", slog.Any("error", err))
 		panic(err)
 	}
-	mysqlPosition = gomysql.Position{Name: mp.File, Pos: mp.Position}
-	slog.Info("get mysql position", slog.Any("position", mysqlPosition))
-	var tableNames []string
-	err = db.Raw(`
-SELECT
-	CONCAT( TABLE_SCHEMA, '.', TABLE_NAME )
-FROM
-	INFORMATION_SCHEMA.TABLES 
-WHERE
-	TABLE_SCHEMA NOT IN ( 'information_schema', 'mysql', 'sys', 'performance_schema' );`,
-	).Scan(&tableNames).Error
-	if err != nil {
-		slog.Error("execute mysql `get table name`", slog.Any("error", err))
+	if err = LoadSchemaHistory(); err != nil {
+		slog.Error("load schema history ", slog.Any("error", err))
 		panic(err)
 	}
-	for key, rule := range Config.Rules {
-		if !slices.Contains(includeTableRegex, rule.TableRegex) {
-			includeTableRegex = append(includeTableRegex, rule.TableRegex)
+	// 需要初始化数据的规则在同一个一致性快照中读取
+	needSnapshot := lo.SomeBy(lo.Entries(RulesConfig()), func(item lo.Entry[string, SyncRule]) bool {
+		return item.Value.InitData && !SnapshotDone(item.Key)
+	})
+	var session *SnapshotSession
+	if needSnapshot {
+		// 继续上次中断的初始化时从断点同步，从库的快照不能早于已经写入 sink 的事件，先等从库追上主库
+		if resumed && snapshotDB != db {
+			if err = WaitReplicaCatchUp(db, snapshotDB, 10*time.Minute); err != nil {
+				slog.Error("wait snapshot replica ", slog.Any("error", err))
+				panic(err)
+			}
 		}
-		reg, err := regexp.Compile(rule.TableRegex)
+		// 第一次启动时加锁读取快照对应的 binlog 位置，从这个位置开始同步。只有从库允许不加锁，按 gtid_executed 对齐
+		allowNoLock := snapshotDB != db && Config.Snapshot.AllowReplicaWithoutLock
+		session, err = OpenSnapshotSession(snapshotDB, !resumed, allowNoLock, Config.Snapshot.Workers)
 		if err != nil {
-			slog.Error(fmt.Sprintf("%s regexp:", key), slog.Any("error", err))
+			slog.Error("open snapshot session ", slog.Any("error", err))
 			panic(err)
 		}
-		eventRule := EventRule{Reg: reg, Stream: make(chan *EventData, 1024)}
-		eventRules = append(eventRules, eventRule)
-		switch rule.SyncTarget {
-		case "redis":
-			if RedisClient == nil {
-				CreateRedisClient()
-			}
-			c1 := &RedisConsumer{
-				KeyName:             rule.RedisRule.KeyName,
-				KeyType:             rule.RedisRule.KeyType,
-				CustomPKColumn:      rule.CustomPKColumn,
-				SerializationFormat: rule.SerializationFormat,
-				IncludeColumnNames:  rule.IncludeColumnNames,
-				ExcludeColumnNames:  rule.ExcludeColumnNames,
-				FieldNameFormat:     rule.FieldNameFormat,
-				Logger:              slog.Default(),
-			}
-			go direct(c1, eventRule.Stream)
-			// 清空 之前的数据
-			if rule.ClearBeforeData {
-				c1.ClearBeforeData()
-			}
-			// 初始化 数据
-			if rule.InitData {
-				// 初始化数据
-				InitData(db, tableNames, reg, c1)
-			}
-			break
-		case "es7":
-			if Es7Client == nil {
-				CreateElasticsearch7Client()
-			}
-			c1 := &Elasticsearch7Consumer{
-				IndexName:          rule.ElasticsearchRule.IndexName,
-				CustomPKColumn:     rule.CustomPKColumn,
-				IncludeColumnNames: rule.IncludeColumnNames,
-				ExcludeColumnNames: rule.ExcludeColumnNames,
-				FieldNameFormat:    rule.FieldNameFormat,
-				Logger:             slog.Default(),
-			}
-			go direct(c1, eventRule.Stream)
-			// 清空 之前的数据
-			if rule.ClearBeforeData {
-				c1.ClearBeforeData()
-			}
-			// 初始化 数据
-			if rule.InitData {
-				// 初始化数据
-				InitData(db, tableNames, reg, c1)
+		defer func() {
+			if err := session.Close(); err != nil {
+				slog.Error("close snapshot session ", slog.Any("error", err))
 			}
-			break
-		case "es8":
-			if Es8Client == nil {
-				CreateElasticsearch8Client()
-			}
-			c1 := &Elasticsearch8Consumer{
-				IndexName:          rule.ElasticsearchRule.IndexName,
-				CustomPKColumn:     rule.CustomPKColumn,
-				IncludeColumnNames: rule.IncludeColumnNames,
-				ExcludeColumnNames: rule.ExcludeColumnNames,
-				FieldNameFormat:    rule.FieldNameFormat,
-				Logger:             slog.Default(),
-			}
-			go direct(c1, eventRule.Stream)
-			// 清空 之前的数据
-			if rule.ClearBeforeData {
-				c1.ClearBeforeData()
-			}
-			// 初始化 数据
-			if rule.InitData {
-				// 初始化数据
-				InitData(db, tableNames, reg, c1)
+		}()
+	}
+	if resumed {
+		mysqlPosition = Checkpoint()
+		mysqlGTIDSet = CheckpointGTID()
+		slog.Info("resume mysql position", slog.Any("position", mysqlPosition), slog.String("gtidSet", mysqlGTIDSet))
+	} else if session != nil && snapshotDB != db {
+		// 从库的 binlog 位置和主库无关，通过 GTID 对齐
+		if len(session.GTIDSet) == 0 {
+			err = fmt.Errorf("gtid_executed of %s is empty, snapshotAddr requires gtid_mode=ON", mysqlCfg.SnapshotAddr)
+			slog.Error("snapshot mysql ", slog.Any("error", err))
+			panic(err)
+		}
+		mysqlGTIDSet = session.GTIDSet
+		slog.Info("get mysql gtid set", slog.String("gtidSet", mysqlGTIDSet))
+		ResetCheckpointGTID(mysqlGTIDSet)
+	} else {
+		if session != nil {
+			mysqlPosition = session.Position
+		} else {
+			var mp MySqlPosition
+			err = db.Raw("SHOW MASTER STATUS;").Scan(&mp).Error
+			if err != nil {
+				slog.Error("execute mysql `show master status` ", slog.Any("error", err))
+				panic(err)
 			}
-			break
-		default:
-			c1 := &ConsoleConsumer{Logger: slog.Default()}
-			go direct(c1, eventRule.Stream)
-			break
+			mysqlPosition = gomysql.Position{Name: mp.File, Pos: mp.Position}
 		}
+		slog.Info("get mysql position", slog.Any("position", mysqlPosition))
+		// 先保存位置，初始化数据中断之后从同一个位置继续
+		ResetCheckpoint(mysqlPosition)
 	}
-}
-
-func InitData(db *gorm.DB, tableNames []string, reg *regexp.Regexp, c1 Consumer) {
-	newTableNames := lo.Uniq(
-		lo.Filter(tableNames, func(item string, index int) bool {
-			return reg.MatchString(item)
-		}),
-	)
-	for _, tableName := range newTableNames {
-		s1 := strings.Split(tableName, ".")
-		var pkColumns []string
-		err := db.Raw(`SELECT
-	COLUMN_NAME 
-FROM
-	INFORMATION_SCHEMA.KEY_COLUMN_USAGE 
-WHERE
-	TABLE_SCHEMA = ? 
-	AND TABLE_NAME = ? 
-	AND CONSTRAINT_NAME = 'PRIMARY';`, s1[0], s1[1]).
-			Scan(&pkColumns).
-			Error
+	tableNames, err := QueryTableNames(snapshotDB)
+	if err != nil {
+		slog.Error("execute mysql `get table name`", slog.Any("error", err))
+		panic(err)
+	}
+	// 同步的表没有结构历史时，记录开始位置的结构，之后按 DDL 记录新的版本
+	var seedTables []string
+	for _, rule := range RulesConfig() {
+		if reg, err := regexp.Compile(rule.TableRegex); err == nil {
+			seedTables = append(seedTables, lo.Filter(tableNames, func(item string, index int) bool {
+				return reg.MatchString(item)
+			})...)
+		}
+	}
+	if err = SeedSchemaHistory(db, mysqlPosition, lo.Uniq(seedTables)); err != nil {
+		slog.Error("seed schema history", slog.Any("error", err))
+		panic(err)
+	}
+	// 查询的表变化时需要从 binlog 失效缓存
+	for _, table := range LookupTables(RulesConfig()) {
+		includeTableRegex = append(includeTableRegex, regexp.QuoteMeta(table))
+	}
+	for key, rule := range RulesConfig() {
+		if !slices.Contains(includeTableRegex, rule.TableRegex) {
+			includeTableRegex = append(includeTableRegex, rule.TableRegex)
+		}
+		eventRule, err := NewEventRule(key, rule)
+		if err == nil {
+			err = eventRule.Start()
+		}
 		if err != nil {
-			slog.Error("execute mysql `show master status` ", slog.Any("error", err))
+			slog.Error(fmt.Sprintf("%s rule:", key), slog.Any("error", err))
 			panic(err)
 		}
-		var count int64
-		db.Table(tableName).Count(&count)
-		if count < 1 {
-			return
+		AddEventRules(eventRule)
+		// 已经完成过初始化数据，不再清空和初始化
+		if SnapshotDone(key) {
+			continue
 		}
-		slog.Info("init data", slog.String("tableName", tableName), slog.Int64("count", count))
-		pageSize := int64(10000)
-		pageTotal := (count + pageSize - 1) / pageSize
-		for pageIndex := int64(1); pageIndex <= pageTotal; pageIndex++ {
-			var result []map[string]interface{}
-			err := db.Table(tableName).
-				Scopes(Paginate(pageIndex, pageSize)).
-				Find(&result).
-				Error
-			if err != nil {
-				slog.Error("init failed ", slog.String("tableName", tableName), slog.Any("error", err))
-			} else {
-				data := lo.Map(result, func(after map[string]interface{}, index int) *EventData {
-					return &EventData{
-						Action:    canal.InsertAction,
-						TableName: tableName,
-						PKColumns: pkColumns,
-						After:     after,
-					}
-				})
-				c1.BatchAccept(data)
+		// 清空 之前的数据，继续上次中断的初始化时不再清空
+		if rule.ClearBeforeData && !HasSnapshotProgress(key) {
+			eventRule.ClearBeforeData()
+		}
+		// 初始化 数据
+		if rule.InitData {
+			if err = InitData(session, eventRule, tableNames); err != nil {
+				slog.Error(fmt.Sprintf("%s rule init data:", key), slog.Any("error", err))
+				panic(err)
 			}
 		}
+		if rule.ClearBeforeData || rule.InitData {
+			MarkSnapshotDone(key)
+		}
 	}
 }
 
-// Paginate 分页封装
-func Paginate(pageIndex int64, pageSize int64) func(db *gorm.DB) *gorm.DB {
-	return func(db *gorm.DB) *gorm.DB {
-		if pageIndex == 0 {
-			pageIndex = 1
-		}
-		if pageSize <= 0 {
-			pageSize = 10
-		}
-		offset := (pageIndex - 1) * pageSize
-		return db.Offset(int(offset)).Limit(int(pageSize))
+// OpenMysql 连接 mysql
+func OpenMysql(addr, username, password string) (*gorm.DB, error) {
+	// 会话时区使用 UTC，TIMESTAMP 读取的是准确的时间，DATETIME、DATE 的字面值再按 temporal.sourceTimezone 解析
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=UTC&time_zone=%%27%%2B00%%3A00%%27",
+		username, password, addr, "information_schema")
+	return gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: slogGorm.New()})
+}
+
+// QueryTableNames 查询所有的 库名.表名
+func QueryTableNames(db *gorm.DB) ([]string, error) {
+	var tableNames []string
+	err := db.Raw(`
+SELECT
+	CONCAT( TABLE_SCHEMA, '.', TABLE_NAME )
+FROM
+	INFORMATION_SCHEMA.TABLES 
+WHERE
+	TABLE_SCHEMA NOT IN ( 'information_schema', 'mysql', 'sys', 'performance_schema' );`,
+	).Scan(&tableNames).Error
+	return tableNames, err
+}
+
+// CreateSpool 创建规则的磁盘缓冲队列
+func CreateSpool(ruleName string) (*Spool, error) {
+	spoolCfg := Config.Spool
+	dir := filepath.Join(Config.DataDir, "spool", ruleName)
+	spool, err := OpenSpool(dir, spoolCfg.SegmentSizeMB<<20, spoolCfg.MaxSizeMB<<20)
+	if err != nil {
+		slog.Error("open spool ", slog.String("dir", dir), slog.Any("error", err))
+		return nil, err
 	}
+	spool.Sync = true
+	slog.Info("open spool", slog.String("dir", dir), slog.Int64("pending", spool.Len()))
+	return spool, nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Projection 同步的字段：脱敏、包含、排除、重命名、字段名称格式，以及计算字段
+type Projection struct {
+	// 包含的 表格 行 名称。为空，全部行
+	IncludeColumnNames []string `yaml:"includeColumnNames" json:"includeColumnNames"`
+
+	// 排除的 表格 行 名称。为空，全部行
+	ExcludeColumnNames []string `yaml:"excludeColumnNames" json:"excludeColumnNames"`
+
+	// 字段名称格式，小驼峰: lowerCamelCase ，大驼峰：upperCamelCase 其他.不处理
+	FieldNameFormat string `yaml:"fieldNameFormat" json:"fieldNameFormat"`
+
+	// DECIMAL 的输出方式。number: 数字，string: 字符串
+	DecimalFormat string `yaml:"decimalFormat" json:"decimalFormat"`
+
+	// 字段重命名，key 是小写的字段名称
+	ColumnRename map[string]string `yaml:"columnRename" json:"columnRename"`
+
+	// 计算字段
+	ComputedFields []ComputedField `yaml:"computedFields" json:"computedFields"`
+
+	// 字段脱敏，key 是小写的字段名称
+	ColumnTransforms map[string]ColumnTransform `yaml:"columnTransforms" json:"columnTransforms"`
+
+	// 写入事件来源的字段名称，为空不写入
+	SourceField string `yaml:"sourceField" json:"sourceField"`
+}
+
+// ComputedField 计算字段，按原始的字段名称计算
+type ComputedField struct {
+	// 字段名称，同样按 columnRename、fieldNameFormat 转换
+	Name string
+	// 表达式
+	Expr *Filter
+}
+
+// NewProjection 根据规则创建字段投影，解析计算字段 `名称 = 表达式`
+func NewProjection(rule SyncRule) (Projection, error) {
+	projection := Projection{
+		IncludeColumnNames: rule.IncludeColumnNames,
+		ExcludeColumnNames: rule.ExcludeColumnNames,
+		FieldNameFormat:    rule.FieldNameFormat,
+		DecimalFormat:      rule.DecimalFormat,
+		SourceField:        rule.SourceField,
+	}
+	switch projection.DecimalFormat {
+	case "":
+		projection.DecimalFormat = DecimalNumber
+	case DecimalNumber, DecimalString:
+	default:
+		return projection, fmt.Errorf("unknown decimalFormat %q", rule.DecimalFormat)
+	}
+	if len(rule.ColumnRename) > 0 {
+		// viper 会把 key 转成小写，mysql 的字段名称本身不区分大小写
+		projection.ColumnRename = make(map[string]string, len(rule.ColumnRename))
+		for column, name := range rule.ColumnRename {
+			projection.ColumnRename[strings.ToLower(column)] = name
+		}
+	}
+	if len(rule.ColumnTransforms) > 0 {
+		projection.ColumnTransforms = make(map[string]ColumnTransform, len(rule.ColumnTransforms))
+		for column, transform := range rule.ColumnTransforms {
+			if !slices.Contains([]string{TransformMask, TransformHash, TransformRedact, TransformDrop}, transform.Type) {
+				return projection, fmt.Errorf("column %s: unknown transform %q", column, transform.Type)
+			}
+			projection.ColumnTransforms[strings.ToLower(column)] = transform
+		}
+	}
+	for _, field := range rule.ComputedFields {
+		name, expr, ok := strings.Cut(field, "=")
+		name, expr = strings.TrimSpace(name), strings.TrimSpace(expr)
+		if !ok || len(name) == 0 || len(expr) == 0 {
+			return projection, fmt.Errorf("computed field %q, expected `name = expression`", field)
+		}
+		f, err := CompileFilter(expr)
+		if err != nil {
+			return projection, fmt.Errorf("computed field %s: %w", name, err)
+		}
+		projection.ComputedFields = append(projection.ComputedFields, ComputedField{Name: name, Expr: f})
+	}
+	return projection, nil
+}
+
+// Transform 脱敏之后的行，没有配置脱敏时直接返回原来的行
+func (p Projection) Transform(row map[string]interface{}) map[string]interface{} {
+	if len(p.ColumnTransforms) == 0 {
+		return row
+	}
+	newRow := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		transform, ok := p.ColumnTransforms[strings.ToLower(column)]
+		if !ok {
+			newRow[column] = value
+		} else if transform.Type != TransformDrop {
+			newRow[column] = transform.Apply(value)
+		}
+	}
+	return newRow
+}
+
+// Included 字段是否同步，脱敏方式为 drop 的字段不同步
+func (p Projection) Included(column string) bool {
+	if len(p.IncludeColumnNames) > 0 && !slices.Contains(p.IncludeColumnNames, column) ||
+		slices.Contains(p.ExcludeColumnNames, column) {
+		return false
+	}
+	transform, ok := p.ColumnTransforms[strings.ToLower(column)]
+	return !ok || transform.Type != TransformDrop
+}
+
+// Project 转换成写入 sink 的字段，先脱敏，计算字段也按脱敏之后的值计算
+func (p Projection) Project(row map[string]interface{}) map[string]interface{} {
+	row = p.Transform(row)
+	newMap := make(map[string]interface{}, len(row)+len(p.ComputedFields))
+	b1 := len(p.IncludeColumnNames) > 0
+	b2 := len(p.ExcludeColumnNames) > 0
+	for column, value := range row {
+		// 如果 IncludeColumnNames 不包含 字段。或者 ExcludeColumnNames 包含 字段。
+		if b1 && !slices.Contains(p.IncludeColumnNames, column) ||
+			b2 && slices.Contains(p.ExcludeColumnNames, column) {
+			continue
+		}
+		newMap[ConvertColumn(p.FieldNameFormat, p.ColumnRename, column)] = value
+	}
+	for _, field := range p.ComputedFields {
+		newMap[ConvertColumn(p.FieldNameFormat, p.ColumnRename, field.Name)] = field.Expr.Value(row)
+	}
+	return newMap
+}
+
+// WithSource 配置了 sourceField 时把事件的来源写入投影之后的行
+func (p Projection) WithSource(row map[string]interface{}, source *EventSource) map[string]interface{} {
+	if len(p.SourceField) > 0 && source != nil {
+		row[p.SourceField] = source.Fields()
+	}
+	return row
+}
+
+const (
+	TransformMask   = "mask"
+	TransformHash   = "hash"
+	TransformRedact = "redact"
+	TransformDrop   = "drop"
+)
+
+// ColumnTransform 字段脱敏
+type ColumnTransform struct {
+	// 脱敏方式。mask: 保留开头、结尾的字符，hash: 加盐的 SHA-256，redact: 保留格式替换字母和数字，drop: 不同步
+	Type string `yaml:"type" json:"type"`
+
+	// mask 保留开头的字符数
+	KeepFirst int `yaml:"keepFirst" json:"keepFirst"`
+
+	// mask 保留结尾的字符数
+	KeepLast int `yaml:"keepLast" json:"keepLast"`
+
+	// mask、redact 的替换字符。默认: *
+	MaskChar string `yaml:"maskChar" json:"maskChar"`
+
+	// hash 的盐，相同的值和盐得到相同的结果，可以用来查询
+	Salt string `yaml:"salt" json:"salt"`
+}
+
+// Apply 脱敏，NULL 保持不变
+func (t ColumnTransform) Apply(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	s := filterString(value)
+	maskChar := '*'
+	if len(t.MaskChar) > 0 {
+		maskChar = []rune(t.MaskChar)[0]
+	}
+	switch t.Type {
+	case TransformMask:
+		runes := []rune(s)
+		// 保留的字符覆盖了整个值时全部脱敏，短的值不能原样输出
+		keepFirst, keepLast := t.KeepFirst, t.KeepLast
+		if keepFirst+keepLast >= len(runes) {
+			keepFirst, keepLast = 0, 0
+		}
+		for i := range runes {
+			if i >= keepFirst && i < len(runes)-keepLast {
+				runes[i] = maskChar
+			}
+		}
+		return string(runes)
+	case TransformHash:
+		sum := sha256.Sum256([]byte(t.Salt + s))
+		return hex.EncodeToString(sum[:])
+	case TransformRedact:
+		// 保留分隔符、长度，例如 138-1234-5678 -> ***-****-****
+		return strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return maskChar
+			}
+			return r
+		}, s)
+	default:
+		return value
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/schema"
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	projection, err := NewProjection(SyncRule{
+		ExcludeColumnNames: []string{"status"},
+		FieldNameFormat:    "lowerCamelCase",
+		ColumnRename:       map[string]string{"device_sn": "sn"},
+		ComputedFields: []string{
+			"full_name = concat(first_name, ' ', last_name)",
+			"is_active = status == 1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := projection.Project(map[string]interface{}{
+		"device_sn":  "A01",
+		"first_name": "Molly",
+		"last_name":  "Canal",
+		"status":     int8(1),
+	})
+	want := map[string]interface{}{
+		"sn":        "A01",
+		"firstName": "Molly",
+		"lastName":  "Canal",
+		"fullName":  "Molly Canal",
+		"isActive":  true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestColumnTransform(t *testing.T) {
+	cases := []struct {
+		transform ColumnTransform
+		value     interface{}
+		want      interface{}
+	}{
+		{ColumnTransform{Type: TransformMask, KeepFirst: 3, KeepLast: 4}, "13812345678", "138****5678"},
+		{ColumnTransform{Type: TransformMask, KeepFirst: 6, KeepLast: 6}, "abc", "***"},
+		{ColumnTransform{Type: TransformMask, KeepFirst: 1, KeepLast: 1}, "ab", "**"},
+		{ColumnTransform{Type: TransformMask, KeepFirst: 1, KeepLast: 1}, "张三丰", "张*丰"},
+		{ColumnTransform{Type: TransformRedact, MaskChar: "#"}, "138-1234-5678", "###-####-####"},
+		{ColumnTransform{Type: TransformHash, Salt: "s"}, "13812345678", "ea2bff308b5e1246e76b8d06973e19405439fecfcb9ebba91edec738722d1c84"},
+		{ColumnTransform{Type: TransformHash}, nil, nil},
+	}
+	for _, c := range cases {
+		if got := c.transform.Apply(c.value); got != c.want {
+			t.Errorf("%+v %v: got %v, want %v", c.transform, c.value, got, c.want)
+		}
+	}
+}
+
+func TestDebeziumEnvelope(t *testing.T) {
+	projection, _ := NewProjection(SyncRule{})
+	envelope := DebeziumEnvelope(&EventData{
+		Action:    "update",
+		TableName: "test.t_user",
+		Before:    map[string]interface{}{"id": 1, "name": "a"},
+		After:     map[string]interface{}{"id": 1, "name": "b"},
+		Source:    &EventSource{File: "mysql-bin.000001", Pos: 120, GTID: "uuid:5", ServerID: 1, TsMs: 1000},
+	}, projection)
+	source := envelope["source"].(map[string]interface{})
+	if envelope["op"] != "u" || source["db"] != "test" || source["table"] != "t_user" ||
+		source["gtid"] != "uuid:5" || source["pos"] != uint32(120) || source["snapshot"] != "false" {
+		t.Errorf("envelope %v", envelope)
+	}
+	snapshot := DebeziumEnvelope(&EventData{
+		Action:    "insert",
+		TableName: "test.t_user",
+		After:     map[string]interface{}{"id": 1},
+		Source:    &EventSource{Snapshot: true},
+	}, projection)
+	if snapshot["op"] != "r" || snapshot["before"].(map[string]interface{}) != nil {
+		t.Errorf("snapshot envelope %v", snapshot)
+	}
+}
+
+func TestCanalMaxwellEnvelope(t *testing.T) {
+	projection, _ := NewProjection(SyncRule{})
+	data := &EventData{
+		Action:    "update",
+		TableName: "test.t_user",
+		PKColumns: []string{"id"},
+		Before:    map[string]interface{}{"id": 1, "name": "a", "age": 20},
+		After:     map[string]interface{}{"id": 1, "name": "b", "age": 20},
+		Source:    &EventSource{File: "mysql-bin.000001", Pos: 120, ServerID: 1, TsMs: 2000},
+	}
+	flat := CanalFlatMessage(data, projection)
+	row := flat["data"].([]interface{})[0].(map[string]interface{})
+	old := flat["old"].([]interface{})[0].(map[string]interface{})
+	if flat["type"] != "UPDATE" || flat["database"] != "test" || flat["es"] != int64(2000) ||
+		row["id"] != "1" || row["name"] != "b" || len(old) != 1 || old["name"] != "a" {
+		t.Errorf("canal message %v", flat)
+	}
+	maxwell := MaxwellMessage(data, projection)
+	if maxwell["type"] != "update" || maxwell["ts"] != int64(2) || maxwell["position"] != "mysql-bin.000001:120" ||
+		len(maxwell["old"].(map[string]interface{})) != 1 || maxwell["data"].(map[string]interface{})["id"] != 1 {
+		t.Errorf("maxwell message %v", maxwell)
+	}
+	data.Action, data.Source = "insert", &EventSource{Snapshot: true}
+	if maxwell = MaxwellMessage(data, projection); maxwell["type"] != "bootstrap-insert" {
+		t.Errorf("maxwell bootstrap message %v", maxwell)
+	}
+	// 字段类型按事件位置的结构输出
+	data.Schema = &schema.Table{Schema: "test", Name: "t_user"}
+	data.Schema.AddColumn("id", "int", "", "")
+	data.Schema.AddColumn("name", "varchar(32)", "", "")
+	data.Schema.AddColumn("age", "tinyint unsigned", "", "")
+	flat = CanalFlatMessage(data, projection)
+	if mysqlType := flat["mysqlType"].(map[string]interface{}); mysqlType["age"] != "tinyint unsigned" ||
+		mysqlType["name"] != "varchar(32)" || flat["sqlType"].(map[string]interface{})["name"] != 12 {
+		t.Errorf("canal types %v %v", flat["mysqlType"], flat["sqlType"])
+	}
+}
+
+func TestCloudEvent(t *testing.T) {
+	projection, _ := NewProjection(SyncRule{})
+	event := CloudEvent("json", &EventData{
+		Action:    "delete",
+		TableName: "test.t_user",
+		PKColumns: []string{"id"},
+		Before:    map[string]interface{}{"id": 7, "name": "a"},
+		Source:    &EventSource{File: "mysql-bin.000001", Pos: 120, TsMs: 2000},
+	}, projection)
+	if event["type"] != "test.t_user.delete" || event["id"] != "mysql-bin.000001:120:7" || event["subject"] != "7" ||
+		event["time"] != "1970-01-01T00:00:02Z" || event["data"].(map[string]interface{})["name"] != "a" {
+		t.Errorf("cloud event %v", event)
+	}
+	headers := CloudEventHeaders(event)
+	if headers["ce-specversion"] != "1.0" || headers["Content-Type"] != "application/json" || len(headers["ce-data"]) > 0 {
+		t.Errorf("cloud event headers %v", headers)
+	}
+}
+
+func TestWithSource(t *testing.T) {
+	projection, _ := NewProjection(SyncRule{SourceField: "binlog"})
+	row := projection.WithSource(projection.Project(map[string]interface{}{"id": 1}),
+		&EventSource{File: "mysql-bin.000001", Pos: 120, TxID: "mysql-bin.000001:80"})
+	source, _ := row["binlog"].(map[string]interface{})
+	if row["id"] != 1 || source["pos"] != uint32(120) || source["tx_id"] != "mysql-bin.000001:80" || source["gtid"] != nil {
+		t.Errorf("row %v", row)
+	}
+	projection.SourceField = ""
+	if row = projection.WithSource(map[string]interface{}{"id": 1}, &EventSource{}); len(row) != 1 {
+		t.Errorf("row without source field %v", row)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/samber/lo"
+	"github.com/shopspring/decimal"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TypedProtobuf 按表结构生成的 protobuf 消息序列化
+const TypedProtobuf = "typedProtobuf"
+
+const protoFieldsFile = "proto_fields.json"
+
+var (
+	protoFieldsMu sync.Mutex
+	// 按 规则名称:库名.表名 保存字段的编号，只增加不修改，删除的字段编号也不再使用
+	protoFields map[string]map[string]int32
+)
+
+// ProtoSchema 规则的 protobuf 消息，每张表一个消息，字段按规则的字段投影计算
+type ProtoSchema struct {
+	RuleName string
+
+	// 同步的字段
+	Projection
+
+	// 合并的查询字段
+	Enrich []EnrichRule
+
+	mu       sync.Mutex
+	messages map[string]*protoMessage
+}
+
+type protoMessage struct {
+	// 生成消息的表结构
+	table *schema.Table
+	desc  protoreflect.MessageDescriptor
+	// key 是写入 sink 的字段名称
+	fields map[string]protoreflect.FieldDescriptor
+}
+
+// Marshal 把投影之后的行序列化成表的消息，值为 NULL 的字段不设置
+func (s *ProtoSchema) Marshal(table *schema.Table, row map[string]interface{}) ([]byte, error) {
+	tableName := table.Schema + "." + table.Name
+	message, err := s.message(table)
+	if err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(message.desc)
+	for key, value := range row {
+		fd, ok := message.fields[key]
+		if !ok || value == nil {
+			continue
+		}
+		v, err := protoValue(fd, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", tableName, key, err)
+		}
+		msg.Set(fd, v)
+	}
+	return proto.Marshal(msg)
+}
+
+// Invalidate 表结构变化之后重新生成消息
+func (s *ProtoSchema) Invalidate(tableName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, tableName)
+}
+
+// message 表的消息，事件的表结构和生成消息的不同时重新生成
+func (s *ProtoSchema) message(table *schema.Table) (*protoMessage, error) {
+	tableName := table.Schema + "." + table.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if message, ok := s.messages[tableName]; ok && sameEncodedColumns(message.table, table) {
+		return message, nil
+	}
+	message, err := s.newMessage(table)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tableName, err)
+	}
+	if s.messages == nil {
+		s.messages = map[string]*protoMessage{}
+	}
+	s.messages[tableName] = message
+	return message, nil
+}
+
+func (s *ProtoSchema) newMessage(table *schema.Table) (*protoMessage, error) {
+	file, fields, err := s.FileDescriptor([]*schema.Table{table})
+	if err != nil {
+		return nil, err
+	}
+	fd, err := protodesc.NewFile(file, new(protoregistry.Files))
+	if err != nil {
+		return nil, err
+	}
+	desc := fd.Messages().Get(0)
+	message := &protoMessage{table: table, desc: desc, fields: map[string]protoreflect.FieldDescriptor{}}
+	for _, field := range fields[0] {
+		message.fields[field.Key] = desc.Fields().ByName(protoreflect.Name(safeFieldName(field.Key)))
+	}
+	return message, nil
+}
+
+// FileDescriptor 规则的 proto 文件，每张表一个消息，字段都是 optional，可以区分 NULL
+func (s *ProtoSchema) FileDescriptor(tables []*schema.Table) (*descriptorpb.FileDescriptorProto, [][]schemaField, error) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(s.RuleName + ".proto"),
+		Package: proto.String(protoPackage(s.RuleName)),
+		Syntax:  proto.String("proto3"),
+	}
+	var allFields [][]schemaField
+	for _, table := range tables {
+		fields := schemaFields(s.Projection, s.Enrich, table)
+		numbers, err := protoFieldNumbers(s.RuleName+":"+table.Schema+"."+table.Name, lo.Map(fields, func(item schemaField, index int) string {
+			return safeFieldName(item.Key)
+		}))
+		if err != nil {
+			return nil, nil, err
+		}
+		message := &descriptorpb.DescriptorProto{Name: proto.String(safeTypeName(table.Schema + "_" + table.Name))}
+		for i, field := range fields {
+			name := safeFieldName(field.Key)
+			message.Field = append(message.Field, &descriptorpb.FieldDescriptorProto{
+				Name:           proto.String(name),
+				JsonName:       proto.String(field.Key),
+				Number:         proto.Int32(numbers[i]),
+				Label:          descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:           protoFieldType(field).Enum(),
+				OneofIndex:     proto.Int32(int32(i)),
+				Proto3Optional: proto.Bool(true),
+			})
+			message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + name)})
+		}
+		file.MessageType = append(file.MessageType, message)
+		allFields = append(allFields, fields)
+	}
+	return file, allFields, nil
+}
+
+// protoFieldType mysql 字段类型对应的 protobuf 类型
+func protoFieldType(field schemaField) descriptorpb.FieldDescriptorProto_Type {
+	column := field.Column
+	if column == nil {
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING
+	}
+	switch column.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		if column.IsUnsigned {
+			return descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		}
+		return descriptorpb.FieldDescriptorProto_TYPE_INT64
+	case schema.TYPE_BIT:
+		return descriptorpb.FieldDescriptorProto_TYPE_UINT64
+	case schema.TYPE_FLOAT:
+		if strings.HasPrefix(column.RawType, "float") {
+			return descriptorpb.FieldDescriptorProto_TYPE_FLOAT
+		}
+		return descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+	case schema.TYPE_DATE, schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_TIME:
+		// 按配置的格式输出，epochMillis 是整数
+		if (TemporalValue{Type: column.Type}).Layout() == TemporalEpochMillis {
+			return descriptorpb.FieldDescriptorProto_TYPE_INT64
+		}
+	case schema.TYPE_BINARY:
+		return descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	case schema.TYPE_STRING:
+		if isBinaryColumn(column) {
+			return descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		}
+	}
+	// DECIMAL 按字符串保留精度，JSON 是 json 字符串，ENUM、SET 是名称
+	return descriptorpb.FieldDescriptorProto_TYPE_STRING
+}
+
+// protoValue 转成字段类型的值
+func protoValue(fd protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	if v, ok := value.(TemporalValue); ok {
+		value = v.Format()
+	}
+	switch fd.Kind() {
+	case protoreflect.Int64Kind:
+		if n, err := strconv.ParseInt(ConvertAnyToString(value), 10, 64); err == nil {
+			return protoreflect.ValueOfInt64(n), nil
+		}
+		if f, ok := filterNumber(value); ok {
+			return protoreflect.ValueOfInt64(int64(f)), nil
+		}
+	case protoreflect.Uint64Kind:
+		if n, err := strconv.ParseUint(ConvertAnyToString(value), 10, 64); err == nil {
+			return protoreflect.ValueOfUint64(n), nil
+		}
+		if f, ok := filterNumber(value); ok && f >= 0 {
+			return protoreflect.ValueOfUint64(uint64(f)), nil
+		}
+	case protoreflect.FloatKind:
+		if f, ok := filterNumber(value); ok {
+			return protoreflect.ValueOfFloat32(float32(f)), nil
+		}
+	case protoreflect.DoubleKind:
+		if f, ok := filterNumber(value); ok {
+			return protoreflect.ValueOfFloat64(f), nil
+		}
+	case protoreflect.BytesKind:
+		if b, ok := value.([]byte); ok {
+			return protoreflect.ValueOfBytes(b), nil
+		}
+		return protoreflect.ValueOfBytes([]byte(ConvertAnyToString(value))), nil
+	case protoreflect.StringKind:
+		switch v := value.(type) {
+		case decimal.Decimal:
+			return protoreflect.ValueOfString(v.String()), nil
+		case json.Number:
+			return protoreflect.ValueOfString(v.String()), nil
+		}
+		return protoreflect.ValueOfString(ConvertAnyToString(value)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("cannot convert %T to %s", value, fd.Kind())
+}
+
+func protoPackage(ruleName string) string {
+	return "canal." + strings.ToLower(safeFieldName(ruleName))
+}
+
+// protoFieldNumbers 字段的编号，新的字段使用最大的编号加一，保存在数据目录
+func protoFieldNumbers(key string, names []string) ([]int32, error) {
+	protoFieldsMu.Lock()
+	defer protoFieldsMu.Unlock()
+	path := filepath.Join(Config.DataDir, protoFieldsFile)
+	if protoFields == nil {
+		protoFields = map[string]map[string]int32{}
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &protoFields); err != nil {
+				return nil, err
+			}
+		}
+	}
+	numbers := protoFields[key]
+	if numbers == nil {
+		numbers = map[string]int32{}
+		protoFields[key] = numbers
+	}
+	changed := false
+	result := make([]int32, len(names))
+	for i, name := range names {
+		number, ok := numbers[name]
+		if !ok {
+			number = 1
+			for _, n := range numbers {
+				number = max(number, n+1)
+			}
+			// 19000 - 19999 是 protobuf 保留的编号
+			if number >= 19000 && number <= 19999 {
+				number = 20000
+			}
+			numbers[name] = number
+			changed = true
+		}
+		result[i] = number
+	}
+	if changed {
+		if err := os.MkdirAll(Config.DataDir, 0755); err != nil {
+			return nil, err
+		}
+		data, err := json.MarshalIndent(protoFields, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ExportProto 为序列化格式是 typedProtobuf 的规则导出 proto 文件，每个规则一个文件
+func ExportProto(dir string) error {
+	db, err := OpenMysql(Config.Mysql.Addr, Config.Mysql.Username, Config.Mysql.Password)
+	if err != nil {
+		return err
+	}
+	mysqlDB = db
+	tableNames, err := QueryTableNames(db)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for ruleName, rule := range RulesConfig() {
+		if rule.SerializationFormat != TypedProtobuf {
+			continue
+		}
+		reg, err := regexp.Compile(rule.TableRegex)
+		if err != nil {
+			return fmt.Errorf("%s regexp: %w", ruleName, err)
+		}
+		projection, err := NewProjection(rule)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ruleName, err)
+		}
+		protoSchema := &ProtoSchema{RuleName: ruleName, Projection: projection, Enrich: rule.Enrich}
+		var tables []*schema.Table
+		for _, tableName := range tableNames {
+			if !reg.MatchString(tableName) {
+				continue
+			}
+			table, err := loadTableSchema(tableName)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, table)
+		}
+		file, _, err := protoSchema.FileDescriptor(tables)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, file.GetName())
+		if err = os.WriteFile(path, []byte(protoFileText(file)), 0644); err != nil {
+			return err
+		}
+		slog.Info("export proto", slog.String("rule", ruleName), slog.String("path", path), slog.Int("messages", len(tables)))
+	}
+	return nil
+}
+
+// protoFileText proto 文件的文本
+func protoFileText(file *descriptorpb.FileDescriptorProto) string {
+	var b strings.Builder
+	b.WriteString("// Code generated by molly-mysql-canal. DO NOT EDIT.\n")
+	b.WriteString("// field numbers are kept in proto_fields.json of the data directory.\n\n")
+	fmt.Fprintf(&b, "syntax = \"%s\";\n\npackage %s;\n", file.GetSyntax(), file.GetPackage())
+	for _, message := range file.MessageType {
+		fmt.Fprintf(&b, "\nmessage %s {\n", message.GetName())
+		fields := slices.Clone(message.Field)
+		slices.SortFunc(fields, func(a, b *descriptorpb.FieldDescriptorProto) int {
+			return int(a.GetNumber() - b.GetNumber())
+		})
+		for _, field := range fields {
+			fmt.Fprintf(&b, "  optional %s %s = %d", protoTypeName(field.GetType()), field.GetName(), field.GetNumber())
+			if field.GetJsonName() != field.GetName() {
+				fmt.Fprintf(&b, " [json_name = %q]", field.GetJsonName())
+			}
+			b.WriteString(";\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func protoTypeName(t descriptorpb.FieldDescriptorProto_Type) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "TYPE_"))
+}
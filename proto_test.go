@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/shopspring/decimal"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"strings"
+	"testing"
+)
+
+func TestProtoSchema(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	protoFields = nil
+	table := &schema.Table{Schema: "test", Name: "t_order"}
+	table.AddColumn("id", "bigint(20) unsigned", "", "")
+	table.AddColumn("amount", "decimal(10,2)", "", "")
+	table.AddColumn("remark", "varchar(64)", "utf8mb4_general_ci", "")
+	table.AddColumn("raw", "varbinary(16)", "", "")
+	projection, err := NewProjection(SyncRule{FieldNameFormat: "lowerCamelCase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ProtoSchema{RuleName: "order", Projection: projection}
+	message, err := s.newMessage(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.messages = map[string]*protoMessage{"test.t_order": message}
+	data, err := s.Marshal(table, projection.Project(map[string]interface{}{
+		"id":     uint64(18446744073709551615),
+		"amount": decimal.RequireFromString("12.50"),
+		"remark": nil,
+		"raw":    []byte{0xff},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := dynamicpb.NewMessage(message.desc)
+	if err = proto.Unmarshal(data, msg); err != nil {
+		t.Fatal(err)
+	}
+	fields := message.desc.Fields()
+	if got := msg.Get(fields.ByName("id")).Uint(); got != 18446744073709551615 {
+		t.Errorf("id %d", got)
+	}
+	if got := msg.Get(fields.ByName("amount")).String(); got != "12.5" {
+		t.Errorf("amount %s", got)
+	}
+	if msg.Has(fields.ByName("remark")) {
+		t.Errorf("remark should be unset")
+	}
+
+	file, _, err := s.FileDescriptor([]*schema.Table{table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := protoFileText(file)
+	for _, line := range []string{
+		"package canal.order;",
+		"message TestTOrder {",
+		"  optional uint64 id = 1;",
+		"  optional bytes raw = 4;",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("missing %q in\n%s", line, text)
+		}
+	}
+
+	// DDL 之前的事件按事件的表结构重新生成消息
+	older := &schema.Table{Schema: "test", Name: "t_order"}
+	older.AddColumn("id", "bigint(20) unsigned", "", "")
+	if _, err = s.Marshal(older, map[string]interface{}{"id": uint64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if s.messages["test.t_order"].table != older {
+		t.Errorf("message not rebuilt for the event schema")
+	}
+
+	// 以数字开头的库名，消息名称加上前缀
+	file, _, err = s.FileDescriptor([]*schema.Table{{Schema: "2024", Name: "t_log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := file.MessageType[0].GetName(); name != "_2024TLog" {
+		t.Errorf("message name %s", name)
+	}
+	if _, err = protodesc.NewFile(file, new(protoregistry.Files)); err != nil {
+		t.Error(err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,32 +17,41 @@ type RedisConsumer struct {
 	// redis 的 key 名称
 	KeyName string `yaml:"keyName" json:"keyName"`
 
-	// redis 的 key 类型。string or hash
+	// redis 的 key 类型。string、hash 或 stream
 	KeyType string `yaml:"keyType" json:"keyType"`
 
+	// stream 的最大长度，0 不限制
+	StreamMaxLen int64 `yaml:"streamMaxLen" json:"streamMaxLen"`
+
 	// 自定义主键
 	CustomPKColumn string `yaml:"customPKColumn" json:"customPKColumn"`
 
-	// 序列化格式，仅支持: msgpack , json
+	// 序列化格式，支持: json、msgpack、yaml、protobuf、typedProtobuf、avro
 	SerializationFormat string `yaml:"serializationFormat" json:"serializationFormat"`
 
-	// 包含的 表格 行 名称。为空，全部行
-	IncludeColumnNames []string `yaml:"includeColumnNames" json:"includeColumnNames"`
+	// 同步的字段
+	Projection
+
+	// 事件的包装格式，为空只写入 after
+	Envelope string `yaml:"envelope" json:"envelope"`
 
-	// 排除的 表格 行 名称。为空，全部行
-	ExcludeColumnNames []string `yaml:"excludeColumnNames" json:"excludeColumnNames"`
+	// CloudEvents 的模式，binary 把属性写成 stream 的字段
+	CloudEventsMode string `yaml:"cloudEventsMode" json:"cloudEventsMode"`
 
-	// 字段名称格式，小驼峰: lowerCamelCase ，大驼峰：upperCamelCase 其他.不处理
-	FieldNameFormat string `yaml:"fieldNameFormat" json:"fieldNameFormat"`
+	// typedProtobuf、avro 按表结构序列化
+	Encoder RowEncoder
 
 	*slog.Logger
 }
 
-func (c *RedisConsumer) Accept(data *EventData) {
-	c.BatchAccept([]*EventData{data})
+func (c *RedisConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
 }
 
-func (c *RedisConsumer) BatchAccept(list []*EventData) {
+func (c *RedisConsumer) BatchAccept(list []*EventData) error {
+	if c.KeyType == "stream" {
+		return c.xadd(list)
+	}
 	ids := lo.Map(
 		lo.Filter(list, func(item *EventData, index int) bool {
 			return item.Action == canal.UpdateAction || item.Action == canal.DeleteAction
@@ -51,23 +61,27 @@ func (c *RedisConsumer) BatchAccept(list []*EventData) {
 		},
 	)
 	if len(ids) > 0 {
-		c.remove(ids)
+		if err := c.remove(ids); err != nil {
+			return err
+		}
 	}
 	newList := lo.Filter(list, func(item *EventData, index int) bool {
 		return item.Action == canal.UpdateAction || item.Action == canal.InsertAction
 	})
 	if len(newList) > 0 {
-		c.insert(newList)
+		return c.insert(newList)
 	}
+	return nil
 }
 
-func (c *RedisConsumer) remove(ids []string) {
+func (c *RedisConsumer) remove(ids []string) error {
 	ctx := context.Background()
 	switch c.KeyType {
 	case "hash":
 		_, err := RedisClient.HDel(ctx, c.KeyName, ids...).Result()
 		if err != nil {
 			slog.Error("redis hash delete", slog.Any("err", err))
+			return err
 		}
 		break
 	default:
@@ -77,52 +91,123 @@ func (c *RedisConsumer) remove(ids []string) {
 		_, err := RedisClient.Del(ctx, newIds...).Result()
 		if err != nil {
 			slog.Error("redis string delete", slog.Any("err", err))
+			return err
 		}
 		break
 	}
+	return nil
 }
 
-func (c *RedisConsumer) insert(list []*EventData) {
-	newMap := lo.Associate(list, func(item *EventData) (string, string) {
+func (c *RedisConsumer) insert(list []*EventData) error {
+	newMap := make(map[string]string, len(list))
+	for _, item := range list {
 		id := ConvertAnyToString(item.After[c.getPKColumn(item)])
-		// 如果 IncludeColumnNames 只有一个 属性
-		if len(c.IncludeColumnNames) == 1 {
-			return id, ConvertAnyToString(item.After[c.IncludeColumnNames[0]])
-		}
-		newMap := make(map[string]interface{}, len(item.After))
-		b1 := len(c.IncludeColumnNames) > 0
-		b2 := len(c.ExcludeColumnNames) > 0
-		for column, value := range item.After {
-			// 如果 IncludeColumnNames 不包含 字段。或者 ExcludeColumnNames 包含 字段。
-			if b1 && !slices.Contains(c.IncludeColumnNames, column) ||
-				b2 && slices.Contains(c.ExcludeColumnNames, column) {
-				continue
-			} else {
-				newMap[ConvertColumn(c.FieldNameFormat, column)] = value
-			}
+		key := id
+		if c.KeyType != "hash" {
+			key = fmt.Sprintf("%s:%s", c.KeyName, id)
 		}
-		buf := ConvertSerializationFormat(c.SerializationFormat, newMap)
-		if c.KeyType == "hash" {
-			return id, buf.String()
-		} else {
-			return fmt.Sprintf("%s:%s", c.KeyName, id), buf.String()
+		value, err := c.encode(item, item.After)
+		if err != nil {
+			return err
 		}
-	})
+		newMap[key] = value
+	}
 	ctx := context.Background()
 	switch c.KeyType {
 	case "hash":
 		_, err := RedisClient.HMSet(ctx, c.KeyName, newMap).Result()
 		if err != nil {
 			slog.Error("redis hash Set", slog.Any("err", err))
+			return err
 		}
 		break
 	default:
 		_, err := RedisClient.MSet(context.Background(), newMap).Result()
 		if err != nil {
 			slog.Error("redis string Set", slog.Any("err", err))
+			return err
 		}
 		break
 	}
+	return nil
+}
+
+// xadd 按顺序写入 stream，每个事件一条消息: action 和序列化之后的 value，删除事件是删除之前的行
+func (c *RedisConsumer) xadd(list []*EventData) error {
+	ctx := context.Background()
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, item := range list {
+			row := item.After
+			if item.Action == canal.DeleteAction {
+				row = item.Before
+			}
+			var values []interface{}
+			if c.Envelope == EnvelopeCloudEvents && c.CloudEventsMode == CloudEventsBinary {
+				values = c.cloudEventValues(item)
+			} else {
+				value, err := c.encode(item, row)
+				if err != nil {
+					return err
+				}
+				values = []interface{}{"action", item.Action, "value", value}
+			}
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: c.KeyName,
+				MaxLen: c.StreamMaxLen,
+				Approx: c.StreamMaxLen > 0,
+				Values: values,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("redis stream add", slog.Any("err", err))
+	}
+	return err
+}
+
+// cloudEventValues CloudEvents binary 模式的 stream 字段: ce-* 属性、content-type，value 只有数据
+func (c *RedisConsumer) cloudEventValues(item *EventData) []interface{} {
+	event := CloudEvent(c.SerializationFormat, item, c.Projection)
+	buf := ConvertSerializationFormat(c.SerializationFormat, c.DecimalFormat, event["data"].(map[string]interface{}))
+	headers := CloudEventHeaders(event)
+	keys := lo.Keys(headers)
+	slices.Sort(keys)
+	values := []interface{}{"action", item.Action}
+	for _, key := range keys {
+		values = append(values, strings.ToLower(key), headers[key])
+	}
+	return append(values, "value", buf.String())
+}
+
+// encode 序列化写入的值。有 envelope 时包装整个事件，否则只有 row
+func (c *RedisConsumer) encode(item *EventData, row map[string]interface{}) (string, error) {
+	if len(c.Envelope) > 0 {
+		value := WrapEnvelope(c.Envelope, c.SerializationFormat, item, c.Projection)
+		buf := ConvertSerializationFormat(c.SerializationFormat, c.DecimalFormat, value)
+		return buf.String(), nil
+	}
+	// 如果 IncludeColumnNames 只有一个 属性
+	if len(c.IncludeColumnNames) == 1 {
+		return ConvertAnyToString(c.Transform(row)[c.IncludeColumnNames[0]]), nil
+	}
+	if c.Encoder != nil {
+		// 使用事件位置的表结构，DDL 之前的事件按旧的结构序列化
+		table, err := eventSchema(item)
+		if err != nil {
+			slog.Error("redis encode schema", slog.String("table", item.TableName), slog.Any("err", err))
+			return "", err
+		}
+		data, err := c.Encoder.Marshal(table, c.Project(row))
+		if err != nil {
+			slog.Error("redis encode", slog.String("format", c.SerializationFormat), slog.Any("err", err))
+			return "", Permanent(err)
+		}
+		return string(data), nil
+	}
+	value := c.WithSource(c.Project(row), item.Source)
+	buf := ConvertSerializationFormat(c.SerializationFormat, c.DecimalFormat, value)
+	return buf.String(), nil
 }
 
 // 获取主键ID
@@ -138,22 +223,67 @@ func (c *RedisConsumer) getPKColumn(item *EventData) string {
 	}
 }
 
-// ClearBeforeData 清除之前的数据
+// AcceptDDL 表结构变化之后重新生成 typedProtobuf、avro 的结构
+func (c *RedisConsumer) AcceptDDL(ev *DDLEvent) error {
+	if c.Encoder != nil {
+		c.Encoder.Invalidate(ev.Schema + "." + ev.Table)
+	}
+	return nil
+}
+
+// ClearBeforeData 清除之前的数据。hash、stream 删除整个 key，string 按 keyName:* 扫描之后分批删除
 func (c *RedisConsumer) ClearBeforeData() {
-	var rdsId string
-	switch c.KeyType {
-	case "hash":
-		rdsId = c.KeyName
-		break
-	default:
-		rdsId = fmt.Sprintf("%s:*", c.KeyName)
-		break
+	ctx := context.Background()
+	if c.KeyType == "hash" || c.KeyType == "stream" {
+		if _, err := RedisClient.Del(ctx, c.KeyName).Result(); err != nil {
+			slog.Error("redis clear before data error", slog.Any("err", err))
+			return
+		}
+		slog.Info("redis clear before data success", slog.Any("redisKey", c.KeyName))
+		return
 	}
-	_, err := RedisClient.Del(context.Background(), rdsId).Result()
-	if err != nil {
-		slog.Error("redis clear before data error", slog.Any("err", err))
+	pattern := fmt.Sprintf("%s:*", c.KeyName)
+	var count atomic.Int64
+	var err error
+	// DEL 不支持通配符，集群需要扫描每个主节点
+	if cluster, ok := RedisClient.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return clearRedisKeys(ctx, client, pattern, &count)
+		})
 	} else {
-		slog.Info("redis clear before data success", slog.Any("redisKey", rdsId))
+		err = clearRedisKeys(ctx, RedisClient, pattern, &count)
+	}
+	if err != nil {
+		slog.Error("redis clear before data error", slog.String("pattern", pattern), slog.Any("err", err))
+		return
+	}
+	slog.Info("redis clear before data success", slog.String("pattern", pattern), slog.Int64("keys", count.Load()))
+}
+
+// clearRedisKeys SCAN 匹配的 key，每批用 UNLINK 删除。集群中的 key 可能不在同一个 slot，逐个删除
+func clearRedisKeys(ctx context.Context, client redis.Cmdable, pattern string, count *atomic.Int64) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.Unlink(ctx, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			count.Add(int64(len(keys)))
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
 	}
 }
 
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"log/slog"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis 测试用的 redis，只支持 SET、SCAN、UNLINK、DEL、XADD，其他命令返回错误
+type fakeRedis struct {
+	mu      sync.Mutex
+	data    map[string]string
+	streams map[string][][]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	server := &fakeRedis{data: map[string]string{}, streams: map[string][][]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			// 按长度读取，值中可能有换行
+			header, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			arg := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		_, _ = conn.Write([]byte(s.exec(args)))
+	}
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		s.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL", "UNLINK":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		// 一次返回所有匹配的 key
+		var keys []string
+		for key := range s.data {
+			if ok, _ := path.Match(args[3], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		reply := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply
+	case "XADD":
+		// XADD key [MAXLEN ~ n] * field value ...
+		index := slices.Index(args, "*")
+		s.streams[args[1]] = append(s.streams[args[1]], args[index+1:])
+		id := fmt.Sprintf("%d-0", len(s.streams[args[1]]))
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestDDLClearStringKeys(t *testing.T) {
+	server, addr := startFakeRedis(t)
+	RedisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{addr}})
+	defer func() { RedisClient = nil }()
+	for _, key := range []string{"cms_device:1", "cms_device:2", "other:1"} {
+		if err := RedisClient.Set(context.Background(), key, "{}", 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rule := &EventRule{
+		Name: "test",
+		Rule: SyncRule{DDL: DDLPolicy{Truncate: DDLPolicyClear}},
+		sink: &RedisConsumer{KeyName: "cms_device", KeyType: "string", Logger: slog.Default()},
+	}
+	if err := rule.applyDDL(&DDLEvent{Type: DDLTruncate, Schema: "test", Table: "cms_device"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	keys := make([]string, 0, len(server.data))
+	for key := range server.data {
+		keys = append(keys, key)
+	}
+	if !slices.Equal(keys, []string{"other:1"}) {
+		t.Errorf("keys after clear %v", keys)
+	}
+}
+
+func TestRedisStreamEnvelope(t *testing.T) {
+	server, addr := startFakeRedis(t)
+	RedisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{addr}})
+	defer func() { RedisClient = nil }()
+	consumer := &RedisConsumer{KeyName: "cms_device", KeyType: "stream", SerializationFormat: "json",
+		Envelope: EnvelopeDebezium, Logger: slog.Default()}
+	err := consumer.BatchAccept([]*EventData{
+		{Action: canal.InsertAction, TableName: "test.cms_device", PKColumns: []string{"id"},
+			After: map[string]interface{}{"id": 1, "name": "tom"}},
+		{Action: canal.DeleteAction, TableName: "test.cms_device", PKColumns: []string{"id"},
+			Before: map[string]interface{}{"id": 1, "name": "tom"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	entries := server.streams["cms_device"]
+	if len(entries) != 2 || entries[0][1] != canal.InsertAction || entries[1][1] != canal.DeleteAction {
+		t.Fatalf("stream entries %v", entries)
+	}
+	var event map[string]interface{}
+	if err = json.Unmarshal([]byte(entries[1][3]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["op"] != "d" || event["before"] == nil {
+		t.Errorf("delete event %v", event)
+	}
+}
+
+func TestRedisStreamCloudEventsBinary(t *testing.T) {
+	server, addr := startFakeRedis(t)
+	RedisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{addr}})
+	defer func() { RedisClient = nil }()
+	consumer := &RedisConsumer{KeyName: "cms_device", KeyType: "stream", SerializationFormat: "json",
+		Envelope: EnvelopeCloudEvents, CloudEventsMode: CloudEventsBinary, Logger: slog.Default()}
+	err := consumer.Accept(&EventData{Action: canal.InsertAction, TableName: "test.cms_device", PKColumns: []string{"id"},
+		After: map[string]interface{}{"id": 1, "name": "tom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	entries := server.streams["cms_device"]
+	if len(entries) != 1 {
+		t.Fatalf("stream entries %v", entries)
+	}
+	// 属性是 stream 的字段，value 只有数据
+	fields := map[string]string{}
+	for i := 0; i+1 < len(entries[0]); i += 2 {
+		fields[entries[0][i]] = entries[0][i+1]
+	}
+	if fields["ce-type"] != "test.cms_device.insert" || fields["ce-subject"] != "1" || fields["content-type"] != "application/json" {
+		t.Errorf("fields %v", fields)
+	}
+	if value := strings.TrimSpace(fields["value"]); value != `{"id":1,"name":"tom"}` {
+		t.Errorf("value %s", value)
+	}
+}
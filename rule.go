@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RuleStateRunning      = "running"
+	RuleStatePaused       = "paused"
+	RuleStateSnapshotting = "snapshotting"
+)
+
+type EventRule struct {
+	// 规则名称
+	Name string
+	// 规则配置
+	Rule SyncRule
+	// 正则表达式
+	Reg *regexp.Regexp
+	// 行过滤表达式，未配置时为空
+	Filter *Filter
+	// 管道
+	Stream chan *EventData
+	// 磁盘缓冲队列，未开启时为空
+	Spool *Spool
+	// 消费者，统计写入数量
+	Consumer Consumer
+	// 同步的目的地
+	sink Consumer
+
+	// 写入管道的事件数量
+	received atomic.Uint64
+	// 处理完成的事件数量，包括写入磁盘缓冲队列
+	done atomic.Uint64
+	// 写入 sink 成功的事件数量
+	delivered atomic.Uint64
+	// 写入 sink 失败的事件数量
+	failed atomic.Uint64
+	// 正在初始化数据
+	snapshotting atomic.Bool
+	// 缓冲队列队头的一批事件连续失败的次数，只在消费的协程中使用
+	spoolRetries int
+
+	mu sync.Mutex
+	// 暂停时不为空，恢复时关闭
+	resumeCh chan struct{}
+	// 停止消费
+	stopCh chan struct{}
+	// 消费已经停止
+	stopped chan struct{}
+	// 规则的指标，停止时注销
+	collectors []prometheus.Collector
+	// 规则的脚本，未配置时为空
+	script *ScriptConsumer
+	// 规则的查询
+	lookups []*Lookup
+}
+
+// RuleStatus 规则的状态和统计
+type RuleStatus struct {
+	Name        string `json:"name"`
+	TableRegex  string `json:"tableRegex"`
+	SyncTarget  string `json:"syncTarget"`
+	State       string `json:"state"`
+	QueueDepth  int    `json:"queueDepth"`
+	SpoolEvents int64  `json:"spoolEvents"`
+	SpoolBytes  int64  `json:"spoolBytes"`
+	Received    uint64 `json:"received"`
+	Delivered   uint64 `json:"delivered"`
+	Failed      uint64 `json:"failed"`
+}
+
+// NewEventRule 根据配置创建规则和消费者，Start 之后开始消费
+func NewEventRule(name string, rule SyncRule) (*EventRule, error) {
+	reg, err := regexp.Compile(rule.TableRegex)
+	if err != nil {
+		return nil, fmt.Errorf("%s regexp: %w", name, err)
+	}
+	eventRule := &EventRule{
+		Name:   name,
+		Rule:   rule,
+		Reg:    reg,
+		Stream: make(chan *EventData, 1024),
+	}
+	if len(rule.Where) > 0 {
+		if eventRule.Filter, err = CompileFilter(rule.Where); err != nil {
+			return nil, fmt.Errorf("%s where: %w", name, err)
+		}
+	}
+	projection, err := NewProjection(rule)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	switch rule.Envelope {
+	case "":
+	case EnvelopeDebezium, EnvelopeCanal, EnvelopeMaxwell, EnvelopeCloudEvents:
+		if rule.SerializationFormat == TypedProtobuf || rule.SerializationFormat == AvroFormat {
+			return nil, fmt.Errorf("%s: envelope %s is not supported with %s", name, rule.Envelope, rule.SerializationFormat)
+		}
+		// 事件包含删除，只有 redis stream 和 console 能写入每个事件
+		switch rule.SyncTarget {
+		case "", "console":
+		case "redis":
+			if rule.RedisRule.KeyType != "stream" {
+				return nil, fmt.Errorf("%s: envelope %s needs redisRule.keyType stream", name, rule.Envelope)
+			}
+		default:
+			return nil, fmt.Errorf("%s: envelope %s is not supported with %s", name, rule.Envelope, rule.SyncTarget)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown envelope %q", name, rule.Envelope)
+	}
+	// envelope 已经包含来源，typedProtobuf、avro 的结构只有表的字段
+	if len(rule.SourceField) > 0 && (len(rule.Envelope) > 0 ||
+		rule.SerializationFormat == TypedProtobuf || rule.SerializationFormat == AvroFormat) {
+		return nil, fmt.Errorf("%s: sourceField is not supported with envelope or %s", name, rule.SerializationFormat)
+	}
+	switch rule.CloudEventsMode {
+	case "", CloudEventsStructured:
+	case CloudEventsBinary:
+		// console 输出消息头，redis stream 把属性写成字段，其他 sink 只能使用 structured
+		withHeaders := rule.SyncTarget == "" || rule.SyncTarget == "console" ||
+			rule.SyncTarget == "redis" && rule.RedisRule.KeyType == "stream"
+		if rule.Envelope != EnvelopeCloudEvents || !withHeaders {
+			return nil, fmt.Errorf("%s: cloudEventsMode binary needs envelope cloudevents and a sink with headers", name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown cloudEventsMode %q", name, rule.CloudEventsMode)
+	}
+	eventRule.sink = CreateConsumer(name, rule, projection)
+	var consumer Consumer = &DDLConsumer{Consumer: eventRule.sink, Rule: eventRule}
+	if len(rule.Script) > 0 {
+		timeout, err := time.ParseDuration(Config.Script.Timeout)
+		if err != nil {
+			timeout = 100 * time.Millisecond
+		}
+		if eventRule.script, err = NewScriptConsumer(name, rule.Script, timeout, consumer); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		consumer = eventRule.script
+	}
+	for _, enrich := range rule.Enrich {
+		lookup, err := NewLookup(enrich)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		eventRule.lookups = append(eventRule.lookups, lookup)
+	}
+	if len(eventRule.lookups) > 0 {
+		consumer = &EnrichConsumer{Consumer: consumer, RuleName: name, Spool: rule.Spool, Lookups: eventRule.lookups}
+	}
+	eventRule.Consumer = &MetricsConsumer{Consumer: consumer, Rule: eventRule}
+	return eventRule, nil
+}
+
+// Start 打开磁盘缓冲队列，开始消费管道中的事件
+func (r *EventRule) Start() error {
+	if r.Rule.Spool {
+		spool, err := CreateSpool(r.Name)
+		if err != nil {
+			return err
+		}
+		r.Spool = spool
+	}
+	r.collectors = RegisterRuleMetrics(r)
+	RegisterLookups(r.lookups)
+	r.stopCh = make(chan struct{})
+	r.stopped = make(chan struct{})
+	go func() {
+		defer close(r.stopped)
+		direct(r)
+	}()
+	return nil
+}
+
+// Stop 停止消费，管道中剩余的事件处理完 (或者写入磁盘缓冲队列) 之后返回
+func (r *EventRule) Stop() {
+	close(r.stopCh)
+	<-r.stopped
+	if r.Spool != nil {
+		if err := r.Spool.Close(); err != nil {
+			slog.Error("spool close", slog.String("rule", r.Name), slog.Any("err", err))
+		}
+	}
+	if r.script != nil {
+		r.script.Close()
+	}
+	UnregisterLookups(r.lookups)
+	UnregisterRuleMetrics(r.collectors)
+	slog.Info("rule stopped", slog.String("rule", r.Name))
+}
+
+// StartSnapshot 暂停规则，在后台初始化数据，完成之后再恢复。期间的事件在恢复之后按顺序覆盖。
+// 初始化成功才调用 onDone
+func (r *EventRule) StartSnapshot(db *gorm.DB, tableNames []string, onDone func()) error {
+	if !r.snapshotting.CompareAndSwap(false, true) {
+		return fmt.Errorf("rule %s is snapshotting", r.Name)
+	}
+	go func() {
+		defer r.snapshotting.Store(false)
+		paused := r.Paused()
+		r.Pause()
+		slog.Info("snapshot rule", slog.String("rule", r.Name), slog.Any("tables", tableNames))
+		if err := r.snapshot(db, tableNames); err != nil {
+			slog.Error("snapshot rule", slog.String("rule", r.Name), slog.Any("err", err))
+		} else {
+			ClearSnapshotProgress(r.Name, tableNames)
+			if onDone != nil {
+				onDone()
+			}
+		}
+		if !paused {
+			r.Resume()
+		}
+	}()
+	return nil
+}
+
+// snapshot 在一致性快照中初始化数据。期间的事件在管道中等待，之后按顺序覆盖快照的数据
+func (r *EventRule) snapshot(db *gorm.DB, tableNames []string) error {
+	// 从库的快照可能早于已经写入 sink 的事件，先等从库追上主库
+	if db != mysqlDB {
+		if err := WaitReplicaCatchUp(mysqlDB, db, 10*time.Minute); err != nil {
+			return err
+		}
+	}
+	session, err := OpenSnapshotSession(db, false, false, Config.Snapshot.Workers)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := session.Close(); err != nil {
+			slog.Error("close snapshot session", slog.String("rule", r.Name), slog.Any("err", err))
+		}
+	}()
+	return InitData(session, r, tableNames)
+}
+
+// CreateConsumer 根据同步的目的地创建消费者
+func CreateConsumer(name string, rule SyncRule, projection Projection) Consumer {
+	switch rule.SyncTarget {
+	case "redis":
+		if RedisClient == nil {
+			CreateRedisClient()
+		}
+		consumer := &RedisConsumer{
+			KeyName:             rule.RedisRule.KeyName,
+			KeyType:             rule.RedisRule.KeyType,
+			StreamMaxLen:        rule.RedisRule.StreamMaxLen,
+			CustomPKColumn:      rule.CustomPKColumn,
+			SerializationFormat: rule.SerializationFormat,
+			Envelope:            rule.Envelope,
+			CloudEventsMode:     rule.CloudEventsMode,
+			Projection:          projection,
+			Logger:              slog.Default(),
+		}
+		switch rule.SerializationFormat {
+		case TypedProtobuf:
+			consumer.Encoder = &ProtoSchema{RuleName: name, Projection: projection, Enrich: rule.Enrich}
+		case AvroFormat:
+			consumer.Encoder = &AvroSchema{RuleName: name, Projection: projection, Enrich: rule.Enrich, Registry: GetSchemaRegistry()}
+		}
+		return consumer
+	case "es7":
+		if Es7Client == nil {
+			CreateElasticsearch7Client()
+		}
+		return &Elasticsearch7Consumer{
+			IndexName:      rule.ElasticsearchRule.IndexName,
+			CustomPKColumn: rule.CustomPKColumn,
+			Projection:     projection,
+			Logger:         slog.Default(),
+		}
+	case "es8":
+		if Es8Client == nil {
+			CreateElasticsearch8Client()
+		}
+		return &Elasticsearch8Consumer{
+			IndexName:      rule.ElasticsearchRule.IndexName,
+			CustomPKColumn: rule.CustomPKColumn,
+			Projection:     projection,
+			Logger:         slog.Default(),
+		}
+	default:
+		return &ConsoleConsumer{
+			Envelope:        rule.Envelope,
+			CloudEventsMode: rule.CloudEventsMode,
+			Projection:      projection,
+			Logger:          slog.Default(),
+		}
+	}
+}
+
+// Target 同步的目的地
+func (r *EventRule) Target() string {
+	if len(r.Rule.SyncTarget) == 0 {
+		return "console"
+	}
+	return r.Rule.SyncTarget
+}
+
+// ClearBeforeData 清空之前的数据，仅支持 redis、es7、es8
+func (r *EventRule) ClearBeforeData() {
+	if c1, ok := r.sink.(Clearable); ok {
+		c1.ClearBeforeData()
+	}
+}
+
+// Match 事件是否满足行过滤条件，不满足时返回空。更新之后不再满足条件时转成删除，
+// 一直满足条件但是关注的字段都没有变化时跳过
+func (r *EventRule) Match(data *EventData) *EventData {
+	if r.Filter == nil {
+		if data.Action == canal.UpdateAction {
+			return r.skipUnchanged(data)
+		}
+		return data
+	}
+	switch data.Action {
+	case canal.InsertAction:
+		if r.Filter.Match(data.After) {
+			return data
+		}
+	case canal.DeleteAction:
+		if r.Filter.Match(data.Before) {
+			return data
+		}
+	case canal.UpdateAction:
+		after, before := r.Filter.Match(data.After), r.Filter.Match(data.Before)
+		if after && before {
+			return r.skipUnchanged(data)
+		}
+		// 之前不满足条件，sink 中没有这一行，需要完整写入
+		if after {
+			return data
+		}
+		if before {
+			return &EventData{
+				Action:    canal.DeleteAction,
+				TableName: data.TableName,
+				PKColumns: data.PKColumns,
+				Before:    data.Before,
+				Source:    data.Source,
+				Schema:    data.Schema,
+			}
+		}
+	default:
+		return data
+	}
+	return nil
+}
+
+// skipUnchanged 关注的字段都没有变化时返回空
+func (r *EventRule) skipUnchanged(data *EventData) *EventData {
+	if r.watchedChanged(data) {
+		return data
+	}
+	eventsSkipped.WithLabelValues(r.Name).Inc()
+	return nil
+}
+
+// watchedChanged 更新事件中 triggerColumns 或者同步的字段是否有变化，主键变化时总是同步
+func (r *EventRule) watchedChanged(data *EventData) bool {
+	changed := func(column string) bool {
+		return !reflect.DeepEqual(data.Before[column], data.After[column])
+	}
+	if slices.ContainsFunc(data.PKColumns, changed) ||
+		len(r.Rule.CustomPKColumn) > 0 && changed(r.Rule.CustomPKColumn) {
+		return true
+	}
+	if len(r.Rule.TriggerColumns) > 0 {
+		return slices.ContainsFunc(r.Rule.TriggerColumns, changed)
+	}
+	include, exclude := r.Rule.IncludeColumnNames, r.Rule.ExcludeColumnNames
+	if len(include) == 0 && len(exclude) == 0 {
+		return true
+	}
+	for column := range data.After {
+		if len(include) > 0 && !slices.Contains(include, column) || slices.Contains(exclude, column) {
+			continue
+		}
+		if changed(column) {
+			return true
+		}
+	}
+	return false
+}
+
+// Push 写入管道
+func (r *EventRule) Push(data *EventData) {
+	r.received.Add(1)
+	r.Stream <- data
+}
+
+// Pause 暂停消费，事件写入磁盘缓冲队列，没有开启时写入临时的缓冲队列
+func (r *EventRule) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resumeCh == nil {
+		r.resumeCh = make(chan struct{})
+		slog.Info("rule paused", slog.String("rule", r.Name))
+	}
+}
+
+// Resume 恢复消费
+func (r *EventRule) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resumeCh != nil {
+		close(r.resumeCh)
+		r.resumeCh = nil
+		slog.Info("rule resumed", slog.String("rule", r.Name))
+	}
+}
+
+// Paused 是否暂停
+func (r *EventRule) Paused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resumeCh != nil
+}
+
+// waitIfPaused 暂停时阻塞，直到恢复或者停止
+func (r *EventRule) waitIfPaused() {
+	r.mu.Lock()
+	ch := r.resumeCh
+	r.mu.Unlock()
+	if ch != nil {
+		select {
+		case <-ch:
+		case <-r.stopCh:
+		}
+	}
+}
+
+// stopping 是否已经要求停止
+func (r *EventRule) stopping() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status 规则的状态和统计
+func (r *EventRule) Status() RuleStatus {
+	status := RuleStatus{
+		Name:       r.Name,
+		TableRegex: r.Rule.TableRegex,
+		SyncTarget: r.Target(),
+		State:      RuleStateRunning,
+		QueueDepth: len(r.Stream),
+		Received:   r.received.Load(),
+		Delivered:  r.delivered.Load(),
+		Failed:     r.failed.Load(),
+	}
+	if r.snapshotting.Load() {
+		status.State = RuleStateSnapshotting
+	} else if r.Paused() {
+		status.State = RuleStatePaused
+	}
+	if r.Spool != nil {
+		status.SpoolEvents = r.Spool.Len()
+		status.SpoolBytes = r.Spool.Size()
+	}
+	return status
+}
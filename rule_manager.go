@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// 当前生效的规则，只整体替换，不修改
+	activeRules atomic.Pointer[[]*EventRule]
+	// 替换规则时，等待正在处理的 binlog 事件完成
+	rulesSwapMu sync.RWMutex
+	// 同一时间只执行一次热加载
+	reloadMu sync.Mutex
+	// 热加载替换 Config.Rules 时加锁，其他地方通过 RulesConfig 读取
+	rulesConfigMu sync.RWMutex
+)
+
+// RulesConfig 当前配置的规则，热加载时整体替换，不修改
+func RulesConfig() map[string]SyncRule {
+	rulesConfigMu.RLock()
+	defer rulesConfigMu.RUnlock()
+	return Config.Rules
+}
+
+// ActiveRules 当前生效的规则
+func ActiveRules() []*EventRule {
+	rules := activeRules.Load()
+	if rules == nil {
+		return nil
+	}
+	return *rules
+}
+
+// FindEventRule 根据名称查找规则
+func FindEventRule(name string) *EventRule {
+	for _, rule := range ActiveRules() {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// AddEventRules 添加生效的规则
+func AddEventRules(rules ...*EventRule) {
+	swapRules(func(list []*EventRule) []*EventRule {
+		return append(list, rules...)
+	})
+}
+
+// swapRules 替换生效的规则，返回之后 binlog 事件不会再写入被移除的规则
+func swapRules(fn func([]*EventRule) []*EventRule) {
+	rulesSwapMu.Lock()
+	defer rulesSwapMu.Unlock()
+	list := fn(slices.Clone(ActiveRules()))
+	activeRules.Store(&list)
+}
+
+// WatchRules 监听配置文件，规则变化时热加载
+func WatchRules() {
+	if !Config.ReloadRules {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		var newConfig AppConfig
+		if err := viper.Unmarshal(&newConfig); err != nil {
+			slog.Error("viper Unmarshal ", slog.Any("error", err))
+			return
+		}
+		slog.Info("config file changed", slog.String("file", e.Name))
+		ReloadRules(newConfig.Rules)
+	})
+	viper.WatchConfig()
+}
+
+// ReloadRules 对比新旧规则，启动新增的规则，停止移除的规则，重新配置修改的规则。binlog 同步不中断
+func ReloadRules(rules map[string]SyncRule) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for _, old := range ActiveRules() {
+		rule, ok := rules[old.Name]
+		if ok && reflect.DeepEqual(rule, old.Rule) {
+			continue
+		}
+		if !ok {
+			// 移除的规则
+			swapRules(func(list []*EventRule) []*EventRule {
+				return slices.DeleteFunc(list, func(item *EventRule) bool {
+					return item == old
+				})
+			})
+			old.Stop()
+			slog.Info("rule removed", slog.String("rule", old.Name))
+			continue
+		}
+		// 修改的规则，新规则先接收事件，旧规则处理完剩余的事件之后再开始消费
+		eventRule, err := buildEventRule(old.Name, rule)
+		if err != nil {
+			slog.Error("reload rule", slog.String("rule", old.Name), slog.Any("err", err))
+			continue
+		}
+		replaceRule(old, eventRule)
+		old.Stop()
+		if err = eventRule.Start(); err != nil {
+			slog.Error("reload rule start, restore the old rule", slog.String("rule", old.Name), slog.Any("err", err))
+			restoreRule(old, eventRule)
+			continue
+		}
+		slog.Info("rule changed", slog.String("rule", old.Name))
+	}
+	for name, rule := range rules {
+		if FindEventRule(name) != nil {
+			continue
+		}
+		// 新增的规则
+		eventRule, err := buildEventRule(name, rule)
+		if err == nil {
+			err = eventRule.Start()
+		}
+		if err != nil {
+			slog.Error("reload rule", slog.String("rule", name), slog.Any("err", err))
+			continue
+		}
+		AddEventRules(eventRule)
+		slog.Info("rule added", slog.String("rule", name))
+		initAddedRule(eventRule)
+	}
+	rulesConfigMu.Lock()
+	Config.Rules = rules
+	rulesConfigMu.Unlock()
+}
+
+// buildEventRule 创建规则，创建 sink 的客户端失败时 panic，热加载时转换成错误，不退出进程
+func buildEventRule(name string, rule SyncRule) (eventRule *EventRule, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("create rule %s: %v", name, r)
+		}
+	}()
+	return NewEventRule(name, rule)
+}
+
+// replaceRule 用 newRule 替换 old，之后的事件写入 newRule 的管道
+func replaceRule(old, newRule *EventRule) {
+	swapRules(func(list []*EventRule) []*EventRule {
+		if index := slices.Index(list, old); index >= 0 {
+			list[index] = newRule
+		}
+		return list
+	})
+}
+
+// restoreRule 新规则启动失败，按旧的配置重新创建规则，接收新规则管道中等待的事件。
+// 重新创建也失败时保留新规则，事件留在管道中，断点不再前进，不会丢失
+func restoreRule(old, failed *EventRule) {
+	restored, err := buildEventRule(old.Name, old.Rule)
+	if err == nil {
+		err = restored.Start()
+	}
+	if err != nil {
+		slog.Error("restore rule", slog.String("rule", old.Name), slog.Any("err", err))
+		return
+	}
+	swapRules(func(list []*EventRule) []*EventRule {
+		if index := slices.Index(list, failed); index >= 0 {
+			list[index] = restored
+		}
+		// 持有 rulesSwapMu，binlog 不会同时写入，按顺序转移
+		for {
+			select {
+			case data := <-failed.Stream:
+				restored.Push(data)
+			default:
+				return list
+			}
+		}
+	})
+	slog.Info("rule restored", slog.String("rule", old.Name))
+}
+
+// initAddedRule 新增的规则，清空之前的数据，只初始化这个规则的数据
+func initAddedRule(eventRule *EventRule) {
+	rule := eventRule.Rule
+	if SnapshotDone(eventRule.Name) || !rule.ClearBeforeData && !rule.InitData {
+		return
+	}
+	if rule.ClearBeforeData && !HasSnapshotProgress(eventRule.Name) {
+		eventRule.ClearBeforeData()
+	}
+	if !rule.InitData {
+		MarkSnapshotDone(eventRule.Name)
+		return
+	}
+	tableNames, err := QueryTableNames(snapshotDB)
+	if err != nil {
+		slog.Error("execute mysql `get table name`", slog.Any("error", err))
+		return
+	}
+	err = eventRule.StartSnapshot(snapshotDB, tableNames, func() {
+		MarkSnapshotDone(eventRule.Name)
+	})
+	if err != nil {
+		slog.Error("snapshot rule", slog.String("rule", eventRule.Name), slog.Any("err", err))
+	}
+}
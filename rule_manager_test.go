@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadRuleStartFailure(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	old, err := NewEventRule("test", SyncRule{TableRegex: "test\\.t_user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	AddEventRules(old)
+	defer func() {
+		for _, rule := range ActiveRules() {
+			rule.Stop()
+		}
+		swapRules(func([]*EventRule) []*EventRule { return nil })
+	}()
+	// spool 的目录是文件，新规则启动失败
+	if err = os.MkdirAll(filepath.Join(Config.DataDir, "spool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(Config.DataDir, "spool", "test"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ReloadRules(map[string]SyncRule{"test": {TableRegex: "test\\.t_user", Spool: true}})
+
+	rule := FindEventRule("test")
+	if rule == nil || rule == old || rule.Rule.Spool {
+		t.Fatalf("restored rule %+v", rule)
+	}
+	rule.Push(&EventData{Action: "insert", TableName: "test.t_user", After: map[string]interface{}{"id": 1}})
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	_ "github.com/pingcap/tidb/pkg/parser/test_driver"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const schemaHistoryFile = "schema_history.json"
+
+// SchemaVersion 表从某个 binlog 位置开始的结构
+type SchemaVersion struct {
+	// 从这个位置开始生效
+	Position MySqlPosition `json:"position"`
+
+	Columns   []schema.TableColumn `json:"columns"`
+	PKColumns []int                `json:"pkColumns"`
+}
+
+var (
+	schemaHistoryMu sync.Mutex
+	// 按表名称索引，每张表的结构按位置排序
+	schemaHistory = map[string][]SchemaVersion{}
+)
+
+func (v SchemaVersion) position() gomysql.Position {
+	return gomysql.Position{Name: v.Position.File, Pos: v.Position.Position}
+}
+
+// LoadSchemaHistory 读取数据目录中的表结构历史
+func LoadSchemaHistory() error {
+	schemaHistoryMu.Lock()
+	defer schemaHistoryMu.Unlock()
+	data, err := os.ReadFile(filepath.Join(Config.DataDir, schemaHistoryFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &schemaHistory)
+}
+
+// saveSchemaHistory 先写临时文件再重命名，调用之前需要持有 schemaHistoryMu
+func saveSchemaHistory() error {
+	if err := os.MkdirAll(Config.DataDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(schemaHistory, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(Config.DataDir, schemaHistoryFile)
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// RecordSchema 记录表从 pos 开始的结构。
+// 重新同步之前的 binlog 时，已经有之后的版本，这时数据库的结构比 pos 新，不再记录
+func RecordSchema(pos gomysql.Position, table *schema.Table) {
+	if len(pos.Name) == 0 {
+		return
+	}
+	tableName := table.Schema + "." + table.Name
+	schemaHistoryMu.Lock()
+	defer schemaHistoryMu.Unlock()
+	versions := schemaHistory[tableName]
+	if n := len(versions); n > 0 {
+		if versions[n-1].position().Compare(pos) >= 0 {
+			return
+		}
+		if slices.EqualFunc(versions[n-1].Columns, table.Columns, sameColumn) &&
+			slices.Equal(versions[n-1].PKColumns, table.PKColumns) {
+			return
+		}
+	}
+	versions = append(versions, SchemaVersion{
+		Position:  MySqlPosition{File: pos.Name, Position: pos.Pos},
+		Columns:   slices.Clone(table.Columns),
+		PKColumns: slices.Clone(table.PKColumns),
+	})
+	// 保存的位置之前只需要保留最后一个版本
+	checkpoint := Checkpoint()
+	for len(versions) > 1 && len(checkpoint.Name) > 0 && versions[1].position().Compare(checkpoint) <= 0 {
+		versions = versions[1:]
+	}
+	schemaHistory[tableName] = versions
+	if err := saveSchemaHistory(); err != nil {
+		slog.Error("save schema history", slog.Any("err", err))
+	}
+}
+
+// SchemaAt 表在 pos 时的结构。没有历史时只能使用当前的结构，和当前结构相同时返回 table
+func SchemaAt(pos gomysql.Position, table *schema.Table) *schema.Table {
+	if len(pos.Name) == 0 {
+		return table
+	}
+	tableName := table.Schema + "." + table.Name
+	schemaHistoryMu.Lock()
+	versions := schemaHistory[tableName]
+	schemaHistoryMu.Unlock()
+	if len(versions) == 0 {
+		return table
+	}
+	index := -1
+	for i, version := range versions {
+		if version.position().Compare(pos) > 0 {
+			break
+		}
+		index = i
+	}
+	// 比最早的记录还早，只能使用最早的结构
+	version := versions[max(index, 0)]
+	if slices.EqualFunc(version.Columns, table.Columns, sameColumn) && slices.Equal(version.PKColumns, table.PKColumns) {
+		return table
+	}
+	return &schema.Table{
+		Schema:    table.Schema,
+		Name:      table.Name,
+		Columns:   version.Columns,
+		PKColumns: version.PKColumns,
+	}
+}
+
+// sameColumn 名称和类型都相同。RawType 的显示宽度和版本有关，不比较
+func sameColumn(a, b schema.TableColumn) bool {
+	return a.Name == b.Name && a.Type == b.Type && a.IsUnsigned == b.IsUnsigned &&
+		slices.Equal(a.EnumValues, b.EnumValues) && slices.Equal(a.SetValues, b.SetValues)
+}
+
+// SeedSchemaHistory 开始同步之前，为没有历史的表记录当前的结构，作为 pos 时的结构
+func SeedSchemaHistory(db *gorm.DB, pos gomysql.Position, tableNames []string) error {
+	if len(pos.Name) == 0 {
+		return nil
+	}
+	for _, tableName := range tableNames {
+		schemaHistoryMu.Lock()
+		_, ok := schemaHistory[tableName]
+		schemaHistoryMu.Unlock()
+		if ok {
+			continue
+		}
+		dbName, name, _ := strings.Cut(tableName, ".")
+		table, err := QueryTableSchema(db, dbName, name)
+		if err != nil {
+			return fmt.Errorf("seed schema history %s: %w", tableName, err)
+		}
+		RecordSchema(pos, table)
+	}
+	return nil
+}
+
+// latestSchema 历史中表的最新结构，没有历史时返回空
+func latestSchema(tableName string) *schema.Table {
+	schemaHistoryMu.Lock()
+	defer schemaHistoryMu.Unlock()
+	versions := schemaHistory[tableName]
+	if len(versions) == 0 {
+		return nil
+	}
+	version := versions[len(versions)-1]
+	dbName, name, _ := strings.Cut(tableName, ".")
+	return &schema.Table{
+		Schema:    dbName,
+		Name:      name,
+		Columns:   slices.Clone(version.Columns),
+		PKColumns: slices.Clone(version.PKColumns),
+	}
+}
+
+// RecordDDL 按 DDL 语句从之前的结构计算新的结构，记录为 pos 开始的版本，返回已经记录的表。
+// 重新同步之前的 binlog 时数据库的结构可能已经更新，不能使用 canal 的表结构
+func RecordDDL(pos gomysql.Position, defaultSchema, query string) []string {
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		slog.Warn("parse ddl", slog.String("query", query), slog.Any("err", err))
+		return nil
+	}
+	var recorded []string
+	record := func(table *schema.Table) {
+		RecordSchema(pos, table)
+		recorded = append(recorded, table.Schema+"."+table.Name)
+	}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.CreateTableStmt:
+			dbName, name := ddlTableName(s.Table, defaultSchema)
+			if s.ReferTable != nil {
+				// CREATE TABLE ... LIKE 复制之前的结构
+				referSchema, referName := ddlTableName(s.ReferTable, defaultSchema)
+				if table := latestSchema(referSchema + "." + referName); table != nil {
+					table.Schema, table.Name = dbName, name
+					record(table)
+				}
+				continue
+			}
+			if s.Select != nil {
+				continue
+			}
+			table := &schema.Table{Schema: dbName, Name: name}
+			var pk []string
+			for _, def := range s.Cols {
+				table.Columns = append(table.Columns, ddlColumn(def))
+				if ddlColumnIsPK(def) {
+					pk = append(pk, def.Name.Name.O)
+				}
+			}
+			for _, constraint := range s.Constraints {
+				if constraint.Tp == ast.ConstraintPrimaryKey {
+					pk = ddlKeyNames(constraint)
+				}
+			}
+			setPKColumns(table, pk)
+			record(table)
+		case *ast.AlterTableStmt:
+			dbName, name := ddlTableName(s.Table, defaultSchema)
+			table := latestSchema(dbName + "." + name)
+			if table == nil {
+				continue
+			}
+			if alterSchema(table, s.Specs, defaultSchema) {
+				record(table)
+			}
+		case *ast.RenameTableStmt:
+			for _, item := range s.TableToTables {
+				oldSchema, oldName := ddlTableName(item.OldTable, defaultSchema)
+				if table := latestSchema(oldSchema + "." + oldName); table != nil {
+					table.Schema, table.Name = ddlTableName(item.NewTable, defaultSchema)
+					record(table)
+				}
+			}
+		}
+	}
+	return recorded
+}
+
+// alterSchema 按 ALTER TABLE 修改字段和主键，不支持的修改返回 false
+func alterSchema(table *schema.Table, specs []*ast.AlterTableSpec, defaultSchema string) bool {
+	pk := lo.Map(table.PKColumns, func(index int, _ int) string {
+		return table.Columns[index].Name
+	})
+	columnIndex := func(name string) int {
+		return slices.IndexFunc(table.Columns, func(column schema.TableColumn) bool {
+			return strings.EqualFold(column.Name, name)
+		})
+	}
+	// 按位置插入字段
+	insert := func(column schema.TableColumn, position *ast.ColumnPosition) bool {
+		index := len(table.Columns)
+		if position != nil {
+			switch position.Tp {
+			case ast.ColumnPositionFirst:
+				index = 0
+			case ast.ColumnPositionAfter:
+				if index = columnIndex(position.RelativeColumn.Name.O); index < 0 {
+					return false
+				}
+				index++
+			}
+		}
+		table.Columns = slices.Insert(table.Columns, index, column)
+		return true
+	}
+	renamePK := func(oldName, newName string) {
+		for i, name := range pk {
+			if strings.EqualFold(name, oldName) {
+				pk[i] = newName
+			}
+		}
+	}
+	for _, spec := range specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, def := range spec.NewColumns {
+				// 重新同步时字段可能已经存在
+				if columnIndex(def.Name.Name.O) >= 0 {
+					continue
+				}
+				if !insert(ddlColumn(def), spec.Position) {
+					return false
+				}
+				if ddlColumnIsPK(def) {
+					pk = []string{def.Name.Name.O}
+				}
+			}
+		case ast.AlterTableDropColumn:
+			if index := columnIndex(spec.OldColumnName.Name.O); index >= 0 {
+				table.Columns = slices.Delete(table.Columns, index, index+1)
+				pk = slices.DeleteFunc(pk, func(name string) bool {
+					return strings.EqualFold(name, spec.OldColumnName.Name.O)
+				})
+			}
+		case ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+			def := spec.NewColumns[0]
+			oldName := def.Name.Name.O
+			if spec.Tp == ast.AlterTableChangeColumn {
+				oldName = spec.OldColumnName.Name.O
+			}
+			index := columnIndex(oldName)
+			if index < 0 {
+				// 重新同步时字段可能已经改名
+				if index = columnIndex(def.Name.Name.O); index < 0 {
+					return false
+				}
+			}
+			column := ddlColumn(def)
+			if spec.Position == nil || spec.Position.Tp == ast.ColumnPositionNone {
+				table.Columns[index] = column
+			} else {
+				table.Columns = slices.Delete(table.Columns, index, index+1)
+				if !insert(column, spec.Position) {
+					return false
+				}
+			}
+			renamePK(oldName, def.Name.Name.O)
+		case ast.AlterTableRenameColumn:
+			if index := columnIndex(spec.OldColumnName.Name.O); index >= 0 {
+				table.Columns[index].Name = spec.NewColumnName.Name.O
+			}
+			renamePK(spec.OldColumnName.Name.O, spec.NewColumnName.Name.O)
+		case ast.AlterTableAddConstraint:
+			if spec.Constraint.Tp == ast.ConstraintPrimaryKey {
+				pk = ddlKeyNames(spec.Constraint)
+			}
+		case ast.AlterTableDropPrimaryKey:
+			pk = nil
+		case ast.AlterTableRenameTable:
+			table.Schema, table.Name = ddlTableName(spec.NewTable, defaultSchema)
+		}
+	}
+	setPKColumns(table, pk)
+	return true
+}
+
+// ddlTableName 没有指定库名时使用当前的库
+func ddlTableName(name *ast.TableName, defaultSchema string) (string, string) {
+	if len(name.Schema.O) > 0 {
+		return name.Schema.O, name.Name.O
+	}
+	return defaultSchema, name.Name.O
+}
+
+// ddlColumn 字段定义转换成和 SHOW FULL COLUMNS 相同的结构
+func ddlColumn(def *ast.ColumnDef) schema.TableColumn {
+	collation, extra := def.Tp.GetCollate(), ""
+	for _, option := range def.Options {
+		switch option.Tp {
+		case ast.ColumnOptionCollate:
+			collation = option.StrValue
+		case ast.ColumnOptionAutoIncrement:
+			extra = "auto_increment"
+		}
+	}
+	table := &schema.Table{}
+	table.AddColumn(def.Name.Name.O, strings.ToLower(def.Tp.InfoSchemaStr()), collation, extra)
+	return table.Columns[0]
+}
+
+func ddlColumnIsPK(def *ast.ColumnDef) bool {
+	return slices.ContainsFunc(def.Options, func(option *ast.ColumnOption) bool {
+		return option.Tp == ast.ColumnOptionPrimaryKey
+	})
+}
+
+func ddlKeyNames(constraint *ast.Constraint) []string {
+	var names []string
+	for _, key := range constraint.Keys {
+		if key.Column != nil {
+			names = append(names, key.Column.Name.O)
+		}
+	}
+	return names
+}
+
+// setPKColumns 按名称设置主键的位置
+func setPKColumns(table *schema.Table, pk []string) {
+	table.PKColumns = nil
+	for _, name := range pk {
+		index := slices.IndexFunc(table.Columns, func(column schema.TableColumn) bool {
+			return strings.EqualFold(column.Name, name)
+		})
+		if index >= 0 {
+			table.PKColumns = append(table.PKColumns, index)
+		}
+	}
+}
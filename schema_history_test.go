@@ -0,0 +1,57 @@
+package main
+
+import (
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"testing"
+)
+
+func TestSchemaAt(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	old := &schema.Table{Schema: "test", Name: "t_user", PKColumns: []int{0},
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}}}
+	current := &schema.Table{Schema: "test", Name: "t_user", PKColumns: []int{0},
+		Columns: []schema.TableColumn{{Name: "id"}, {Name: "age"}, {Name: "name"}}}
+	RecordSchema(gomysql.Position{Name: "mysql-bin.000001", Pos: 100}, old)
+	RecordSchema(gomysql.Position{Name: "mysql-bin.000002", Pos: 4}, current)
+	if err := LoadSchemaHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	row := anyToObj([]interface{}{1, "tom"}, SchemaAt(gomysql.Position{Name: "mysql-bin.000001", Pos: 500}, current))
+	if row["name"] != "tom" {
+		t.Fatalf("old row %v", row)
+	}
+	if table := SchemaAt(gomysql.Position{Name: "mysql-bin.000002", Pos: 200}, current); table != current {
+		t.Fatalf("new row %v", table.Columns)
+	}
+}
+
+func TestRecordDDL(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	schemaHistory = map[string][]SchemaVersion{}
+	RecordDDL(gomysql.Position{Name: "mysql-bin.000001", Pos: 100}, "test",
+		"CREATE TABLE t_order (id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT, amount INT, PRIMARY KEY (id))")
+	recorded := RecordDDL(gomysql.Position{Name: "mysql-bin.000001", Pos: 200}, "test",
+		"ALTER TABLE t_order ADD COLUMN remark VARCHAR(64) AFTER id, MODIFY amount DECIMAL(10,2)")
+	if len(recorded) != 1 || recorded[0] != "test.t_order" {
+		t.Fatalf("recorded %v", recorded)
+	}
+	current := &schema.Table{Schema: "test", Name: "t_order"}
+	current.AddColumn("id", "bigint unsigned", "", "auto_increment")
+	current.AddColumn("remark", "varchar(64)", "", "")
+	current.AddColumn("amount", "decimal(10,2)", "", "")
+	current.PKColumns = []int{0}
+	if table := SchemaAt(gomysql.Position{Name: "mysql-bin.000001", Pos: 300}, current); table != current {
+		t.Fatalf("after alter %v", table.Columns)
+	}
+
+	// 字段名称相同，类型不同
+	table := SchemaAt(gomysql.Position{Name: "mysql-bin.000001", Pos: 150}, current)
+	if len(table.Columns) != 2 || table.Columns[1].Name != "amount" || table.Columns[1].Type != schema.TYPE_NUMBER {
+		t.Fatalf("before alter %v", table.Columns)
+	}
+	if !table.Columns[0].IsUnsigned || len(table.PKColumns) != 1 || table.PKColumns[0] != 0 {
+		t.Fatalf("before alter pk %v %v", table.Columns, table.PKColumns)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchemaRegistry 注册 avro 的结构，返回结构的编号，相同的结构返回相同的编号
+type SchemaRegistry interface {
+	Register(subject, schema string) (int, error)
+}
+
+var (
+	schemaRegistryOnce sync.Once
+	schemaRegistry     SchemaRegistry
+)
+
+// GetSchemaRegistry 配置了 url 使用 Confluent 兼容的 schema registry，否则使用本地文件
+func GetSchemaRegistry() SchemaRegistry {
+	schemaRegistryOnce.Do(func() {
+		cfg := Config.SchemaRegistry
+		if len(cfg.Url) > 0 {
+			schemaRegistry = &ConfluentRegistry{
+				Url:      strings.TrimSuffix(cfg.Url, "/"),
+				Username: cfg.Username,
+				Password: cfg.Password,
+				client:   &http.Client{Timeout: 10 * time.Second},
+			}
+			return
+		}
+		path := cfg.Path
+		if len(path) == 0 {
+			path = filepath.Join(Config.DataDir, "schema_registry.json")
+		}
+		schemaRegistry = &FileRegistry{Path: path}
+	})
+	return schemaRegistry
+}
+
+// ConfluentRegistry Confluent schema registry 的 REST 接口
+type ConfluentRegistry struct {
+	Url      string
+	Username string
+	Password string
+
+	client *http.Client
+}
+
+func (r *ConfluentRegistry) Register(subject, schema string) (int, error) {
+	body, _ := json.Marshal(map[string]string{"schema": schema})
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("%s/subjects/%s/versions", r.Url, url.PathEscape(subject)), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if len(r.Username) > 0 {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("schema registry %s: %s %s", subject, resp.Status, strings.TrimSpace(string(data)))
+	}
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return 0, fmt.Errorf("schema registry %s: %w", subject, err)
+	}
+	return result.ID, nil
+}
+
+// FileRegistry 保存在本地文件的 schema registry，离线使用
+type FileRegistry struct {
+	Path string
+
+	mu   sync.Mutex
+	data *fileRegistryData
+}
+
+type fileRegistryData struct {
+	// 按编号保存的结构
+	Schemas map[int]string `json:"schemas"`
+	// 每个 subject 的版本，按注册的顺序保存结构的编号
+	Subjects map[string][]int `json:"subjects"`
+}
+
+func (r *FileRegistry) Register(subject, schema string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.data == nil {
+		r.data = &fileRegistryData{Schemas: map[int]string{}, Subjects: map[string][]int{}}
+		data, err := os.ReadFile(r.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, r.data); err != nil {
+				return 0, fmt.Errorf("schema registry %s: %w", r.Path, err)
+			}
+		}
+	}
+	id := 0
+	for schemaID, s := range r.data.Schemas {
+		if s == schema {
+			id = schemaID
+			break
+		}
+	}
+	versions := r.data.Subjects[subject]
+	if id > 0 && slices.Contains(versions, id) {
+		return id, nil
+	}
+	if id == 0 {
+		for schemaID := range r.data.Schemas {
+			id = max(id, schemaID)
+		}
+		id++
+		r.data.Schemas[id] = schema
+	}
+	r.data.Subjects[subject] = append(versions, id)
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return 0, err
+	}
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err = os.WriteFile(r.Path+".tmp", data, 0644); err != nil {
+		return 0, err
+	}
+	return id, os.Rename(r.Path+".tmp", r.Path)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/shopspring/decimal"
+	lua "github.com/yuin/gopher-lua"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// luaMaxSafeInteger lua 的数字是 float64，超过的整数按字符串传递
+const luaMaxSafeInteger = 1 << 53
+
+// ScriptConsumer 在写入 sink 之前执行规则的 lua 脚本。
+// 脚本定义 function transform(event)，返回 nil 丢弃事件，返回 event 或者 event 数组写入 sink。
+// event 的字段: action、table、pk_columns、before、after。值为 NULL 的字段在 lua 的 table 中不存在
+type ScriptConsumer struct {
+	Consumer
+
+	// 规则名称，脚本出错的事件写入这个规则的死信文件
+	RuleName string
+
+	// 每个事件的执行时间限制
+	Timeout time.Duration
+
+	// LState 不能并发使用
+	mu        sync.Mutex
+	state     *lua.LState
+	transform *lua.LFunction
+}
+
+// NewScriptConsumer 加载脚本，只开启 base、table、string、math 库，并且不能加载其他文件
+func NewScriptConsumer(ruleName, path string, timeout time.Duration, next Consumer) (*ScriptConsumer, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), max(timeout, time.Second))
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.DoFile(path)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, fmt.Errorf("load script %s: %w", path, err)
+	}
+	transform, ok := L.GetGlobal("transform").(*lua.LFunction)
+	if !ok {
+		L.Close()
+		return nil, fmt.Errorf("script %s: function transform(event) not defined", path)
+	}
+	return &ScriptConsumer{
+		Consumer:  next,
+		RuleName:  ruleName,
+		Timeout:   timeout,
+		state:     L,
+		transform: transform,
+	}, nil
+}
+
+func (c *ScriptConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
+}
+
+func (c *ScriptConsumer) BatchAccept(list []*EventData) error {
+	c.mu.Lock()
+	newList := make([]*EventData, 0, len(list))
+	for _, data := range list {
+		if data.DDL != nil {
+			newList = append(newList, data)
+			continue
+		}
+		events, err := c.run(data)
+		if err != nil {
+			// 脚本出错的事件写入死信文件，不阻塞后面的事件
+			WriteDeadLetter(c.RuleName, data, fmt.Errorf("script: %w", err))
+			continue
+		}
+		newList = append(newList, events...)
+	}
+	c.mu.Unlock()
+	if len(newList) == 0 {
+		return nil
+	}
+	return c.Consumer.BatchAccept(newList)
+}
+
+// Close 关闭 lua 虚拟机
+func (c *ScriptConsumer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Close()
+}
+
+// run 执行 transform(event)，返回替换之后的事件
+func (c *ScriptConsumer) run(data *EventData) ([]*EventData, error) {
+	L := c.state
+	if c.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		L.SetContext(ctx)
+		defer L.RemoveContext()
+	}
+	err := L.CallByParam(lua.P{Fn: c.transform, NRet: 1, Protect: true}, eventToLua(L, data))
+	if err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	switch v := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case *lua.LTable:
+		// 有 action 字段是单个事件，否则是事件数组
+		if v.RawGetString("action") != lua.LNil {
+			event, err := eventFromLua(v, data)
+			if err != nil {
+				return nil, err
+			}
+			return []*EventData{event}, nil
+		}
+		var events []*EventData
+		for i := 1; i <= v.Len(); i++ {
+			item, ok := v.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("transform returned a non-table item at %d", i)
+			}
+			event, err := eventFromLua(item, data)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		return events, nil
+	default:
+		return nil, fmt.Errorf("transform returned %s, expected nil or table", ret.Type())
+	}
+}
+
+func eventToLua(L *lua.LState, data *EventData) *lua.LTable {
+	event := L.NewTable()
+	event.RawSetString("action", lua.LString(data.Action))
+	event.RawSetString("table", lua.LString(data.TableName))
+	pkColumns := L.NewTable()
+	for _, column := range data.PKColumns {
+		pkColumns.Append(lua.LString(column))
+	}
+	event.RawSetString("pk_columns", pkColumns)
+	if data.Before != nil {
+		event.RawSetString("before", rowToLua(L, data.Before))
+	}
+	if data.After != nil {
+		event.RawSetString("after", rowToLua(L, data.After))
+	}
+	return event
+}
+
+func rowToLua(L *lua.LState, row map[string]interface{}) *lua.LTable {
+	tbl := L.CreateTable(0, len(row))
+	for column, value := range row {
+		tbl.RawSetString(column, valueToLua(value))
+	}
+	return tbl
+}
+
+func valueToLua(value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float32:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case decimal.Decimal:
+		// lua 的数字是 float64，按字符串传递保留精度
+		return lua.LString(v.String())
+	}
+	if f, ok := filterNumber(value); ok {
+		if _, isString := value.([]byte); !isString && math.Abs(f) <= luaMaxSafeInteger {
+			return lua.LNumber(f)
+		}
+	}
+	return lua.LString(filterString(value))
+}
+
+func eventFromLua(tbl *lua.LTable, origin *EventData) (*EventData, error) {
+	data := &EventData{
+		Action:    origin.Action,
+		TableName: origin.TableName,
+		PKColumns: origin.PKColumns,
+		Source:    origin.Source,
+	}
+	if action, ok := tbl.RawGetString("action").(lua.LString); ok {
+		data.Action = string(action)
+	}
+	if !slices.Contains([]string{canal.InsertAction, canal.UpdateAction, canal.DeleteAction}, data.Action) {
+		return nil, fmt.Errorf("invalid action %q", data.Action)
+	}
+	if table, ok := tbl.RawGetString("table").(lua.LString); ok {
+		data.TableName = string(table)
+	}
+	// 脚本修改了表名时，字段类型查询新表当前的结构
+	if data.TableName == origin.TableName {
+		data.Schema = origin.Schema
+	}
+	if pkColumns, ok := tbl.RawGetString("pk_columns").(*lua.LTable); ok {
+		data.PKColumns = nil
+		for i := 1; i <= pkColumns.Len(); i++ {
+			data.PKColumns = append(data.PKColumns, pkColumns.RawGetInt(i).String())
+		}
+	}
+	var err error
+	if data.Before, err = rowFromLua(tbl.RawGetString("before"), origin.Before); err != nil {
+		return nil, fmt.Errorf("before: %w", err)
+	}
+	if data.After, err = rowFromLua(tbl.RawGetString("after"), origin.After); err != nil {
+		return nil, fmt.Errorf("after: %w", err)
+	}
+	return data, nil
+}
+
+// rowFromLua 脚本返回的行。没有修改的字段使用原来的值，保留 DECIMAL、时间、二进制、JSON 等类型
+func rowFromLua(value lua.LValue, origin map[string]interface{}) (map[string]interface{}, error) {
+	tbl, ok := value.(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+	row := make(map[string]interface{})
+	var err error
+	tbl.ForEach(func(key, value lua.LValue) {
+		if original, ok := origin[key.String()]; ok && valueToLua(original) == value {
+			row[key.String()] = original
+			return
+		}
+		switch v := value.(type) {
+		case lua.LBool:
+			row[key.String()] = bool(v)
+		case lua.LString:
+			row[key.String()] = string(v)
+		case lua.LNumber:
+			f := float64(v)
+			if f == math.Trunc(f) && math.Abs(f) <= luaMaxSafeInteger {
+				row[key.String()] = int64(f)
+			} else {
+				row[key.String()] = f
+			}
+		default:
+			err = fmt.Errorf("column %s: unsupported %s value", key.String(), value.Type())
+		}
+	})
+	return row, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type recordConsumer struct {
+	list []*EventData
+}
+
+func (c *recordConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
+}
+
+func (c *recordConsumer) BatchAccept(list []*EventData) error {
+	c.list = append(c.list, list...)
+	return nil
+}
+
+func TestScriptConsumer(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	path := filepath.Join(Config.DataDir, "rule.lua")
+	script := `
+function transform(event)
+  if event.after.status == 0 then
+    return nil
+  end
+  if event.after.status == 2 then
+    while true do end
+  end
+  if event.after.status == 3 then
+    local copy = {action = "insert", table = "audit.log", after = {id = event.after.id}}
+    return {event, copy}
+  end
+  event.after.name = string.upper(event.after.name)
+  return event
+end`
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next := &recordConsumer{}
+	c, err := NewScriptConsumer("test", path, 50*time.Millisecond, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	row := func(id int64, status int8) *EventData {
+		return &EventData{Action: "insert", TableName: "db.t", PKColumns: []string{"id"},
+			After: map[string]interface{}{"id": id, "status": status, "name": "molly", "price": decimal.RequireFromString("9.90")}}
+	}
+	err = c.BatchAccept([]*EventData{row(1, 0), row(2, 1), row(3, 2), row(4, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.list) != 3 {
+		t.Fatalf("got %d events, want 3", len(next.list))
+	}
+	if next.list[0].After["name"] != "MOLLY" || next.list[0].After["id"] != int64(2) {
+		t.Errorf("unexpected transform result %v", next.list[0].After)
+	}
+	// 脚本没有修改的字段保留原来的类型
+	if price, ok := next.list[0].After["price"].(decimal.Decimal); !ok || price.String() != "9.9" {
+		t.Errorf("unchanged decimal %#v", next.list[0].After["price"])
+	}
+	if next.list[2].TableName != "audit.log" || next.list[2].PKColumns[0] != "id" {
+		t.Errorf("unexpected fan out result %+v", next.list[2])
+	}
+	// 超时的事件写入死信文件
+	data, err := os.ReadFile(filepath.Join(Config.DataDir, "deadletter", "test.jsonl"))
+	if err != nil || len(data) == 0 {
+		t.Errorf("dead letter not written: %v", err)
+	}
+}
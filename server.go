@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+)
+
+// StartHttpServer 启动 http 服务，提供 /metrics、/healthz、/readyz、/admin 接口
+func StartHttpServer() {
+	addr := Config.Http.Addr
+	if len(addr) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.HandleFunc("GET /readyz", readyz)
+	RegisterAdminHandlers(mux)
+	go func() {
+		slog.Info("http server listen", slog.String("addr", addr))
+		err := http.ListenAndServe(addr, mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http server", slog.Any("err", err))
+		}
+	}()
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/schema"
+	slogGorm "github.com/orandin/slog-gorm"
+	"github.com/samber/lo"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const snapshotPageSize = 10000
+
+// SnapshotProgress 表的初始化数据进度
+type SnapshotProgress struct {
+	// 表拆分的主键范围
+	Chunks []SnapshotChunk `json:"chunks,omitempty"`
+
+	// 是否完成
+	Done bool `json:"done"`
+}
+
+// SnapshotChunk 第一个主键字段的范围 [Start, End)，为空表示不限制
+type SnapshotChunk struct {
+	Start *int64 `json:"start,omitempty"`
+
+	End *int64 `json:"end,omitempty"`
+
+	// 最后一批的主键值，没有主键的表为空
+	LastKey []string `json:"lastKey,omitempty"`
+
+	// 已完成的行数
+	Rows int64 `json:"rows"`
+
+	// 是否完成
+	Done bool `json:"done"`
+}
+
+// Rows 已完成的行数
+func (p SnapshotProgress) Rows() int64 {
+	return lo.SumBy(p.Chunks, func(item SnapshotChunk) int64 {
+		return item.Rows
+	})
+}
+
+// SnapshotSession 一致性快照，每个连接都在同一个时间点开启事务
+type SnapshotSession struct {
+	// 快照事务的连接，每个读取协程一个
+	DBs []*gorm.DB
+	// 快照对应的 binlog 位置，只有加锁时才准确
+	Position gomysql.Position
+	// 快照对应的 gtid_executed，从库初始化数据时从这里开始同步主库
+	GTIDSet string
+	// 原始的连接池，检查从库延迟
+	db    *gorm.DB
+	conns []*sql.Conn
+}
+
+// OpenSnapshotSession 开启 workers 个 START TRANSACTION WITH CONSISTENT SNAPSHOT 事务。
+// lock 为 true 时，在 FLUSH TABLES WITH READ LOCK 期间开启事务并读取 binlog 位置，保证快照和位置一致。
+// 加锁失败时返回错误，allowNoLock 为 true 时不加锁继续
+func OpenSnapshotSession(db *gorm.DB, lock, allowNoLock bool, workers int) (*SnapshotSession, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if lock {
+		lockConn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer lockConn.Close()
+		// 需要 RELOAD 权限，不加锁时快照和位置可能不一致
+		if _, err = lockConn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK;"); err != nil {
+			if !allowNoLock {
+				return nil, fmt.Errorf("flush tables with read lock: %w", err)
+			}
+			slog.Warn("flush tables with read lock, snapshot may not align with gtid_executed", slog.Any("err", err))
+		} else {
+			defer func() {
+				if _, err := lockConn.ExecContext(ctx, "UNLOCK TABLES;"); err != nil {
+					slog.Error("unlock tables", slog.Any("err", err))
+				}
+			}()
+		}
+	}
+	session := &SnapshotSession{db: db}
+	for i := 0; i < max(workers, 1); i++ {
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+		session.conns = append(session.conns, conn)
+		connDB, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}),
+			&gorm.Config{Logger: slogGorm.New(), SkipDefaultTransaction: true})
+		if err == nil {
+			_, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT;")
+		}
+		if err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+		session.DBs = append(session.DBs, connDB)
+	}
+	var mp MySqlPosition
+	if err = session.DBs[0].Raw("SHOW MASTER STATUS;").Scan(&mp).Error; err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	session.Position = gomysql.Position{Name: mp.File, Pos: mp.Position}
+	// 没有开启 GTID 或者 MariaDB 时为空
+	if err = session.DBs[0].Raw("SELECT @@GLOBAL.gtid_executed;").Scan(&session.GTIDSet).Error; err != nil {
+		slog.Warn("select gtid_executed", slog.Any("err", err))
+	}
+	slog.Info("open snapshot session", slog.Bool("lock", lock), slog.Int("workers", len(session.DBs)),
+		slog.Any("position", session.Position), slog.String("gtidSet", session.GTIDSet))
+	return session, nil
+}
+
+// Close 结束快照事务，归还连接
+func (s *SnapshotSession) Close() error {
+	var errs []error
+	for _, conn := range s.conns {
+		if _, err := conn.ExecContext(context.Background(), "COMMIT;"); err != nil {
+			errs = append(errs, err)
+		}
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WaitReplicaCatchUp 等待从库执行完主库当前的 gtid_executed，从库的快照不早于主库的当前位置
+func WaitReplicaCatchUp(primary, replica *gorm.DB, timeout time.Duration) error {
+	var gtidSet string
+	if err := primary.Raw("SELECT @@GLOBAL.gtid_executed;").Scan(&gtidSet).Error; err != nil {
+		return err
+	}
+	var timedOut int
+	err := replica.Raw("SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?);", gtidSet, int(timeout.Seconds())).Scan(&timedOut).Error
+	if err != nil {
+		return err
+	}
+	if timedOut != 0 {
+		return fmt.Errorf("replica did not execute %s within %s", gtidSet, timeout)
+	}
+	return nil
+}
+
+// snapshotTask 一张表的一个主键范围
+type snapshotTask struct {
+	tableName string
+	pkColumns []string
+	// 表结构，按字段类型转换读取的值
+	table *schema.Table
+	index int
+	chunk SnapshotChunk
+}
+
+// InitData 初始化数据。按主键分批读取，多个连接并行读取多张表、多个主键范围。
+// 每批的进度保存在数据目录，中断之后从最后一批继续
+func InitData(session *SnapshotSession, rule *EventRule, tableNames []string) error {
+	ruleName := rule.Name
+	newTableNames := lo.Uniq(
+		lo.Filter(tableNames, func(item string, index int) bool {
+			return rule.Reg.MatchString(item)
+		}),
+	)
+	var tasks []snapshotTask
+	for _, tableName := range newTableNames {
+		list, err := planSnapshot(session.DBs[0], ruleName, tableName)
+		if err != nil {
+			return fmt.Errorf("init data %s: %w", tableName, err)
+		}
+		tasks = append(tasks, list...)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	// 初始化数据的行按快照的 binlog 位置标记来源
+	source := EventSource{File: session.Position.Name, Pos: session.Position.Pos, Snapshot: true}
+	throttle := newSnapshotThrottle(session.db, Config.Snapshot.RowsPerSecond, Config.Snapshot.MaxReplicaLagSeconds)
+	taskCh := make(chan snapshotTask)
+	var wg sync.WaitGroup
+	for _, db := range session.DBs {
+		wg.Add(1)
+		go func(db *gorm.DB) {
+			defer wg.Done()
+			for task := range taskCh {
+				if err := snapshotChunk(ctx, db, throttle, rule, task, source); err != nil {
+					cancel(fmt.Errorf("init data %s: %w", task.tableName, err))
+				}
+			}
+		}(db)
+	}
+	for _, task := range tasks {
+		select {
+		case taskCh <- task:
+		case <-ctx.Done():
+		}
+	}
+	close(taskCh)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// planSnapshot 拆分表的主键范围，已经拆分过的表继续使用保存的范围
+func planSnapshot(db *gorm.DB, ruleName, tableName string) ([]snapshotTask, error) {
+	progress := GetSnapshotProgress(ruleName, tableName)
+	if progress.Done {
+		slog.Info("init data already done", slog.String("tableName", tableName), slog.Int64("rows", progress.Rows()))
+		return nil, nil
+	}
+	s1 := strings.SplitN(tableName, ".", 2)
+	pkColumns, err := QueryPKColumns(db, s1[0], s1[1])
+	if err != nil {
+		return nil, err
+	}
+	table, err := QueryTableSchema(db, s1[0], s1[1])
+	if err != nil {
+		return nil, err
+	}
+	// 统计信息中的估算行数，大表 COUNT(*) 太慢
+	var estimate int64
+	err = db.Raw("SELECT IFNULL(TABLE_ROWS, 0) FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?;",
+		s1[0], s1[1]).Scan(&estimate).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(progress.Chunks) == 0 {
+		progress.Chunks, err = splitChunks(db, tableName, pkColumns, Config.Snapshot.ChunksPerTable)
+		if err != nil {
+			return nil, err
+		}
+		SaveSnapshotProgress(ruleName, tableName, progress)
+	}
+	slog.Info("init data", slog.String("tableName", tableName), slog.Int64("estimate", estimate),
+		slog.Int("chunks", len(progress.Chunks)), slog.Int64("resumeRows", progress.Rows()))
+	snapshotRowsTotal.WithLabelValues(tableName).Set(float64(estimate))
+	snapshotRowsDone.WithLabelValues(tableName).Set(float64(progress.Rows()))
+	var tasks []snapshotTask
+	for i, chunk := range progress.Chunks {
+		if !chunk.Done {
+			tasks = append(tasks, snapshotTask{tableName: tableName, pkColumns: pkColumns, table: table, index: i, chunk: chunk})
+		}
+	}
+	return tasks, nil
+}
+
+// splitChunks 第一个主键字段是整数时，按最小值、最大值平均拆分成 n 个范围
+func splitChunks(db *gorm.DB, tableName string, pkColumns []string, n int) ([]SnapshotChunk, error) {
+	if n <= 1 || len(pkColumns) == 0 {
+		return []SnapshotChunk{{}}, nil
+	}
+	s1 := strings.SplitN(tableName, ".", 2)
+	var dataType string
+	err := db.Raw("SELECT DATA_TYPE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?;",
+		s1[0], s1[1], pkColumns[0]).Scan(&dataType).Error
+	if err != nil {
+		return nil, err
+	}
+	if !lo.Contains([]string{"tinyint", "smallint", "mediumint", "int", "bigint"}, strings.ToLower(dataType)) {
+		return []SnapshotChunk{{}}, nil
+	}
+	var bounds struct {
+		Min sql.NullInt64
+		Max sql.NullInt64
+	}
+	column := quoteIdentifier(pkColumns[0])
+	err = db.Table(tableName).Select(fmt.Sprintf("MIN(%s) AS min, MAX(%s) AS max", column, column)).Scan(&bounds).Error
+	if err != nil {
+		return nil, err
+	}
+	if !bounds.Min.Valid || bounds.Max.Int64-bounds.Min.Int64 < int64(n) {
+		return []SnapshotChunk{{}}, nil
+	}
+	step := (bounds.Max.Int64-bounds.Min.Int64)/int64(n) + 1
+	chunks := make([]SnapshotChunk, n)
+	for i := range chunks {
+		// 第一个范围没有下限，最后一个范围没有上限
+		if i > 0 {
+			chunks[i].Start = lo.ToPtr(bounds.Min.Int64 + int64(i)*step)
+		}
+		if i < n-1 {
+			chunks[i].End = lo.ToPtr(bounds.Min.Int64 + int64(i+1)*step)
+		}
+	}
+	return chunks, nil
+}
+
+// snapshotChunk 按主键分批读取一个范围，每批保存进度
+func snapshotChunk(ctx context.Context, db *gorm.DB, throttle *snapshotThrottle, rule *EventRule, task snapshotTask, source EventSource) error {
+	tableName, pkColumns, chunk := task.tableName, task.pkColumns, task.chunk
+	orderBy := strings.Join(lo.Map(pkColumns, func(item string, index int) string {
+		return quoteIdentifier(item)
+	}), ", ")
+	// 过滤条件中 mysql 可以计算的部分交给 mysql，读取之后仍然按完整的表达式过滤
+	var filterSQL string
+	var filterArgs []interface{}
+	if rule.Filter != nil {
+		filterSQL, filterArgs = rule.Filter.SQL(task.table)
+	}
+	for ctx.Err() == nil {
+		var result []map[string]interface{}
+		query := db.Table(tableName)
+		if len(filterSQL) > 0 {
+			query = query.Where(filterSQL, filterArgs...)
+		}
+		if len(pkColumns) > 0 {
+			first := quoteIdentifier(pkColumns[0])
+			if chunk.Start != nil {
+				query = query.Where(fmt.Sprintf("%s >= ?", first), *chunk.Start)
+			}
+			if chunk.End != nil {
+				query = query.Where(fmt.Sprintf("%s < ?", first), *chunk.End)
+			}
+			// WHERE (pk1, pk2) > (?, ?) ORDER BY pk1, pk2 LIMIT n
+			if len(chunk.LastKey) > 0 {
+				placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(pkColumns)), ", ")
+				query = query.Where(fmt.Sprintf("(%s) > (%s)", orderBy, placeholders), lo.ToAnySlice(chunk.LastKey)...)
+			}
+			query = query.Order(orderBy).Limit(snapshotPageSize)
+		} else {
+			// 没有主键，只能按 OFFSET 分页
+			query = query.Scopes(Paginate(chunk.Rows/snapshotPageSize+1, snapshotPageSize))
+		}
+		if err := query.Find(&result).Error; err != nil {
+			return err
+		}
+		if len(result) > 0 {
+			batchSource := source
+			batchSource.TsMs = time.Now().UnixMilli()
+			data := lo.Map(result, func(after map[string]interface{}, index int) *EventData {
+				return &EventData{
+					Action:    canal.InsertAction,
+					TableName: tableName,
+					PKColumns: pkColumns,
+					After:     ConvertRowValues(task.table, after),
+					Source:    &batchSource,
+					Schema:    task.table,
+				}
+			})
+			// 行过滤表达式和 binlog 的行一样按转换之后的值计算，mysql 的条件可能更宽松，例如排序规则不区分大小写
+			if rule.Filter != nil {
+				data = lo.Filter(data, func(item *EventData, index int) bool {
+					return rule.Filter.Match(item.After)
+				})
+			}
+			if len(data) > 0 {
+				if err := rule.Consumer.BatchAccept(data); err != nil {
+					return err
+				}
+			}
+			chunk.Rows += int64(len(result))
+			if len(pkColumns) > 0 {
+				last := result[len(result)-1]
+				chunk.LastKey = lo.Map(pkColumns, func(item string, index int) string {
+					return keysetValue(last[item])
+				})
+			}
+			snapshotRowsDone.WithLabelValues(tableName).Add(float64(len(result)))
+		}
+		chunk.Done = len(result) < snapshotPageSize
+		progress := UpdateSnapshotChunk(rule.Name, tableName, task.index, chunk)
+		if chunk.Done {
+			if progress.Done {
+				slog.Info("init data done", slog.String("tableName", tableName), slog.Int64("rows", progress.Rows()))
+			}
+			return nil
+		}
+		if err := throttle.Wait(ctx, len(result)); err != nil {
+			return err
+		}
+	}
+	return context.Cause(ctx)
+}
+
+// QueryPKColumns 按顺序查询表的主键
+func QueryPKColumns(db *gorm.DB, schema, table string) ([]string, error) {
+	var pkColumns []string
+	err := db.Raw(`SELECT
+	COLUMN_NAME 
+FROM
+	INFORMATION_SCHEMA.KEY_COLUMN_USAGE 
+WHERE
+	TABLE_SCHEMA = ? 
+	AND TABLE_NAME = ? 
+	AND CONSTRAINT_NAME = 'PRIMARY'
+ORDER BY
+	ORDINAL_POSITION;`, schema, table).
+		Scan(&pkColumns).
+		Error
+	return pkColumns, err
+}
+
+// keysetValue 主键值转成 mysql 可以比较的字符串
+func keysetValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	default:
+		return ConvertAnyToString(v)
+	}
+}
+
+// quoteIdentifier 反引号包裹字段名
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// Paginate 分页封装
+func Paginate(pageIndex int64, pageSize int64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if pageIndex == 0 {
+			pageIndex = 1
+		}
+		if pageSize <= 0 {
+			pageSize = 10
+		}
+		offset := (pageIndex - 1) * pageSize
+		return db.Offset(int(offset)).Limit(int(pageSize))
+	}
+}
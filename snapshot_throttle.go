@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replicaLagCheckInterval 从库延迟过大时，间隔多久再检查
+const replicaLagCheckInterval = 5 * time.Second
+
+// snapshotThrottle 限制初始化数据的读取速度，源库是从库时延迟过大暂停读取
+type snapshotThrottle struct {
+	db            *gorm.DB
+	rowsPerSecond int
+	maxLagSeconds int64
+
+	mu sync.Mutex
+	// 已读取的行数按速度折算，允许继续读取的时间
+	next time.Time
+}
+
+func newSnapshotThrottle(db *gorm.DB, rowsPerSecond int, maxLagSeconds int64) *snapshotThrottle {
+	return &snapshotThrottle{db: db, rowsPerSecond: rowsPerSecond, maxLagSeconds: maxLagSeconds}
+}
+
+// Wait 读取 rows 行之后调用，超过速度或者从库延迟过大时等待
+func (t *snapshotThrottle) Wait(ctx context.Context, rows int) error {
+	if t.rowsPerSecond > 0 && rows > 0 {
+		t.mu.Lock()
+		now := time.Now()
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(rows) * time.Second / time.Duration(t.rowsPerSecond))
+		delay := t.next.Sub(now)
+		t.mu.Unlock()
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+	for t.maxLagSeconds > 0 {
+		lag, ok := t.replicaLag()
+		if !ok || lag <= t.maxLagSeconds {
+			return nil
+		}
+		slog.Warn("replica lag too high, pause snapshot", slog.Int64("lag", lag), slog.Int64("maxLag", t.maxLagSeconds))
+		if err := sleepContext(ctx, replicaLagCheckInterval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicaLag 源库的 Seconds_Behind_Master，不是从库或者复制停止时返回 false
+func (t *snapshotThrottle) replicaLag() (int64, bool) {
+	var status []map[string]interface{}
+	if err := t.db.Raw("SHOW SLAVE STATUS;").Scan(&status).Error; err != nil {
+		slog.Warn("execute mysql `show slave status`", slog.Any("err", err))
+		return 0, false
+	}
+	if len(status) == 0 {
+		return 0, false
+	}
+	value, ok := status[0]["Seconds_Behind_Master"]
+	if !ok {
+		value = status[0]["Seconds_Behind_Source"]
+	}
+	if value == nil {
+		return 0, false
+	}
+	lag, err := strconv.ParseInt(ConvertAnyToString(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return lag, true
+}
+
+// sleepContext 等待 d，ctx 结束时提前返回
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
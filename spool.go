@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSpoolFull 磁盘缓冲队列已满
+var ErrSpoolFull = errors.New("spool is full")
+
+const (
+	spoolSegmentExt  = ".seg"
+	spoolCursorFile  = "cursor"
+	spoolRecordLimit = 64 << 20
+)
+
+func init() {
+	// EventData 中 interface{} 的值，除了基础类型之外都需要注册
+	gob.Register(time.Time{})
+	gob.Register(decimal.Decimal{})
+	gob.Register(TemporalValue{})
+	gob.Register(json.Number(""))
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Spool 磁盘缓冲队列。sink 不可用时，事件按顺序写入分段文件，恢复之后再按顺序消费
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+	// 每次写入之后同步到磁盘，临时的缓冲队列不需要
+	Sync bool
+
+	mu sync.Mutex
+	// 现存的分段编号，升序
+	segments []uint64
+	writer   *os.File
+	// 当前写入分段的大小
+	writeSize int64
+	// 读取位置
+	readSeg    uint64
+	readOffset int64
+	// Peek 之后，Commit 之前的读取位置
+	pendingSeg    uint64
+	pendingOffset int64
+	pendingCount  int64
+	// 未消费的事件数量
+	count int64
+	// 所有分段文件的大小
+	bytes int64
+}
+
+// OpenSpool 打开目录下的磁盘缓冲队列，不存在则创建
+func OpenSpool(dir string, segmentBytes, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seg, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		s.bytes += info.Size()
+	}
+	slices.Sort(s.segments)
+	if err = s.loadCursor(); err != nil {
+		return nil, err
+	}
+	// 统计未消费的事件数量
+	seg, offset := s.readSeg, s.readOffset
+	for {
+		list, nextSeg, nextOffset, err := s.read(seg, offset, 1024)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			break
+		}
+		s.count += int64(len(list))
+		seg, offset = nextSeg, nextOffset
+	}
+	// 总是写入新的分段，上次异常退出时未写完整的记录会在读取时跳过
+	next := s.readSeg
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1] + 1
+	}
+	s.writer, err = os.OpenFile(s.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = append(s.segments, next)
+	return s, nil
+}
+
+// Push 追加事件到队尾
+func (s *Spool) Push(data *EventData) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.bytes+int64(len(record)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+	if s.writeSize > 0 && s.writeSize+int64(len(record)) > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		// 截断未写完整的记录，之后的记录从记录的开始位置写入
+		if truncErr := s.truncate(s.writeSize); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+		return err
+	}
+	// 写入磁盘之后才算处理完成，重启之后不会丢失
+	if s.Sync {
+		if err := s.writer.Sync(); err != nil {
+			if truncErr := s.truncate(s.writeSize); truncErr != nil {
+				return errors.Join(err, truncErr)
+			}
+			return err
+		}
+	}
+	s.writeSize += int64(len(record))
+	s.bytes += int64(len(record))
+	s.count++
+	return nil
+}
+
+// truncate 把当前写入的分段截断到 size
+func (s *Spool) truncate(size int64) error {
+	if err := s.writer.Truncate(size); err != nil {
+		return err
+	}
+	_, err := s.writer.Seek(size, io.SeekStart)
+	return err
+}
+
+// Peek 从队头读取最多 max 个事件，Commit 之前不会移动读取位置
+func (s *Spool) Peek(max int) ([]*EventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, seg, offset, err := s.read(s.readSeg, s.readOffset, max)
+	if err != nil {
+		return nil, err
+	}
+	s.pendingSeg, s.pendingOffset, s.pendingCount = seg, offset, int64(len(list))
+	return list, nil
+}
+
+// Commit 确认 Peek 读取的事件已经消费，并删除消费完的分段文件
+func (s *Spool) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pendingCount == 0 {
+		return nil
+	}
+	s.readSeg, s.readOffset = s.pendingSeg, s.pendingOffset
+	s.count -= s.pendingCount
+	s.pendingCount = 0
+	for len(s.segments) > 1 && s.segments[0] < s.readSeg {
+		if err := s.removeSegment(s.segments[0]); err != nil {
+			return err
+		}
+	}
+	// 全部消费完，截断当前分段，避免文件无限增长
+	if s.count == 0 && s.readSeg == s.segments[len(s.segments)-1] && s.readOffset == s.writeSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.removeSegment(s.segments[0]); err != nil {
+			return err
+		}
+		s.readSeg, s.readOffset = s.segments[0], 0
+	}
+	return s.saveCursor()
+}
+
+// Len 未消费的事件数量
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Size 分段文件占用的字节数
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Close 关闭写入的分段文件
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Close()
+}
+
+// read 从指定位置读取最多 max 个事件，返回下一次读取的位置
+func (s *Spool) read(seg uint64, offset int64, max int) ([]*EventData, uint64, int64, error) {
+	var list []*EventData
+	for _, current := range s.segments {
+		if current < seg {
+			continue
+		}
+		if current > seg {
+			seg, offset = current, 0
+		}
+		f, err := os.Open(s.segmentPath(seg))
+		if err != nil {
+			return nil, seg, offset, err
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, seg, offset, err
+		}
+		reader := bufio.NewReader(f)
+		for len(list) < max {
+			data, n, err := readSpoolRecord(reader)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				_ = f.Close()
+				return nil, seg, offset, fmt.Errorf("spool segment %d offset %d: %w", seg, offset, err)
+			}
+			list = append(list, data)
+			offset += n
+		}
+		_ = f.Close()
+		if len(list) >= max {
+			break
+		}
+	}
+	return list, seg, offset, nil
+}
+
+// readSpoolRecord 读取一条记录，未写完整的记录视为 io.EOF
+func readSpoolRecord(reader *bufio.Reader) (*EventData, int64, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > spoolRecordLimit {
+		return nil, 0, fmt.Errorf("record size %d exceeds limit", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	var data EventData
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+		return nil, 0, err
+	}
+	return &data, int64(size) + 4, nil
+}
+
+// rotate 新建一个分段文件用于写入
+func (s *Spool) rotate() error {
+	if s.Sync {
+		if err := s.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	next := s.segments[len(s.segments)-1] + 1
+	writer, err := os.OpenFile(s.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, next)
+	s.writer = writer
+	s.writeSize = 0
+	return nil
+}
+
+func (s *Spool) removeSegment(seg uint64) error {
+	path := s.segmentPath(seg)
+	info, err := os.Stat(path)
+	if err == nil {
+		s.bytes -= info.Size()
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = slices.DeleteFunc(s.segments, func(item uint64) bool {
+		return item == seg
+	})
+	return nil
+}
+
+func (s *Spool) segmentPath(seg uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seg, spoolSegmentExt))
+}
+
+func (s *Spool) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			if len(s.segments) > 0 {
+				s.readSeg = s.segments[0]
+			}
+			return nil
+		}
+		return err
+	}
+	_, err = fmt.Sscanf(string(data), "%d %d", &s.readSeg, &s.readOffset)
+	return err
+}
+
+// saveCursor 先写临时文件再重命名，保证读取位置不会写坏
+func (s *Spool) saveCursor() error {
+	path := filepath.Join(s.dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", s.readSeg, s.readOffset)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runWithSpool 消费管道中的事件。sink 写入失败、规则暂停或者缓冲队列不为空时，事件先写入缓冲队列，再按顺序重试
+func runWithSpool(rule *EventRule, retryInterval time.Duration) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	// 上次退出时没有消费完的事件
+	draining := rule.Spool.Len() > 0
+	for {
+		if draining && !rule.Paused() && !rule.stopping() {
+			// 先把管道中已有的事件追加到队尾，再消费一批，避免管道写满阻塞 binlog
+			for n := len(rule.Stream); n > 0; n-- {
+				pushSpool(rule, <-rule.Stream, retryInterval)
+			}
+			draining = drainSpool(rule)
+			continue
+		}
+		select {
+		case d1 := <-rule.Stream:
+			if rule.Spool.Len() == 0 && !rule.Paused() {
+				if err := rule.Consumer.Accept(d1); err == nil {
+					rule.done.Add(1)
+					continue
+				}
+				slog.Warn("sink unavailable, spool events", slog.String("rule", rule.Name))
+			}
+			pushSpool(rule, d1, retryInterval)
+		case <-ticker.C:
+			if !rule.Paused() {
+				draining = drainSpool(rule)
+			}
+		case <-rule.stopCh:
+			// 剩余的事件写入缓冲队列，下次启动时继续消费
+			for n := len(rule.Stream); n > 0; n-- {
+				pushSpool(rule, <-rule.Stream, retryInterval)
+			}
+			return
+		}
+	}
+}
+
+// pushSpool 写入缓冲队列，队列满了就阻塞重试，直到有空间
+func pushSpool(rule *EventRule, data *EventData, retryInterval time.Duration) {
+	for {
+		err := rule.Spool.Push(data)
+		if err == nil {
+			rule.done.Add(1)
+			return
+		}
+		slog.Error("spool push", slog.String("rule", rule.Name), slog.Any("err", err))
+		if rule.Paused() || !drainSpool(rule) {
+			time.Sleep(retryInterval)
+		}
+	}
+}
+
+// drainSpool 按顺序消费缓冲队列中的一批事件，成功且队列还有剩余时返回 true
+func drainSpool(rule *EventRule) bool {
+	list, err := rule.Spool.Peek(256)
+	if err != nil {
+		slog.Error("spool peek", slog.String("rule", rule.Name), slog.Any("err", err))
+		return false
+	}
+	if len(list) == 0 {
+		return false
+	}
+	for _, batch := range splitByAction(list) {
+		if err = rule.Consumer.BatchAccept(batch); err == nil {
+			continue
+		}
+		rule.spoolRetries++
+		exhausted := Config.Spool.MaxRetries > 0 && rule.spoolRetries >= Config.Spool.MaxRetries
+		if !IsPermanent(err) && !exhausted {
+			slog.Warn("spool drain", slog.String("rule", rule.Name),
+				slog.Int64("pending", rule.Spool.Len()), slog.Int("retries", rule.spoolRetries), slog.Any("err", err))
+			return false
+		}
+		// sink 拒绝的批次逐个写入，找出无法写入的事件
+		if !acceptEach(rule, batch, exhausted) {
+			return false
+		}
+	}
+	rule.spoolRetries = 0
+	if err = rule.Spool.Commit(); err != nil {
+		slog.Error("spool commit", slog.String("rule", rule.Name), slog.Any("err", err))
+		return false
+	}
+	pending := rule.Spool.Len()
+	if pending == 0 {
+		slog.Info("spool drained", slog.String("rule", rule.Name))
+	}
+	return pending > 0
+}
+
+// acceptEach 逐个写入，sink 拒绝的事件 (超过重试次数时所有失败的事件) 写入死信文件。
+// 其他错误返回 false，下次从这一批重新写入
+func acceptEach(rule *EventRule, batch []*EventData, exhausted bool) bool {
+	for _, data := range batch {
+		err := rule.Consumer.Accept(data)
+		if err == nil {
+			continue
+		}
+		if !exhausted && !IsPermanent(err) {
+			slog.Warn("spool drain", slog.String("rule", rule.Name), slog.Any("err", err))
+			return false
+		}
+		WriteDeadLetter(rule.Name, data, err)
+	}
+	return true
+}
+
+// splitByAction 按连续相同的动作分批，BatchAccept 会先删除再写入，不同动作混在一起会打乱顺序
+func splitByAction(list []*EventData) [][]*EventData {
+	var result [][]*EventData
+	start := 0
+	for i := 1; i <= len(list); i++ {
+		if i == len(list) || list[i].Action != list[start].Action {
+			result = append(result, list[start:i])
+			start = i
+		}
+	}
+	return result
+}
+
+// pauseBuffer 没有开启磁盘缓冲队列的规则暂停时，按顺序暂存事件的临时队列。
+// 恢复之后写入 sink 才算处理完成，检查点不会越过暂存的事件
+type pauseBuffer struct {
+	rule  *EventRule
+	spool *Spool
+}
+
+func (b *pauseBuffer) dir() string {
+	return filepath.Join(Config.DataDir, "spool", b.rule.Name+".paused")
+}
+
+// Push 写入临时队列，失败时等待恢复并返回 false，由调用者直接写入 sink
+func (b *pauseBuffer) Push(data *EventData) bool {
+	if b.spool == nil {
+		// 上次没有消费完的事件在检查点之后，会重新同步
+		_ = os.RemoveAll(b.dir())
+		spool, err := OpenSpool(b.dir(), Config.Spool.SegmentSizeMB<<20, 0)
+		if err != nil {
+			slog.Error("open pause buffer", slog.String("rule", b.rule.Name), slog.Any("err", err))
+			b.rule.waitIfPaused()
+			return false
+		}
+		b.spool = spool
+	}
+	if err := b.spool.Push(data); err != nil {
+		slog.Error("pause buffer push", slog.String("rule", b.rule.Name), slog.Any("err", err))
+		b.rule.waitIfPaused()
+		return false
+	}
+	return true
+}
+
+// Drain 按顺序写入暂存的事件，然后删除临时队列
+func (b *pauseBuffer) Drain() {
+	if b.spool == nil {
+		return
+	}
+	for b.spool.Len() > 0 {
+		list, err := b.spool.Peek(256)
+		if err == nil {
+			for _, data := range list {
+				deliverDirect(b.rule, data)
+			}
+			err = b.spool.Commit()
+		}
+		if err != nil {
+			slog.Error("pause buffer drain", slog.String("rule", b.rule.Name), slog.Any("err", err))
+			break
+		}
+	}
+	b.Close()
+}
+
+// Close 关闭并删除临时队列
+func (b *pauseBuffer) Close() {
+	if b.spool == nil {
+		return
+	}
+	if err := b.spool.Close(); err != nil {
+		slog.Error("pause buffer close", slog.String("rule", b.rule.Name), slog.Any("err", err))
+	}
+	_ = os.RemoveAll(b.dir())
+	b.spool = nil
+}
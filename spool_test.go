@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"github.com/samber/lo"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = spool.Push(&EventData{
+			Action:    "insert",
+			TableName: "test.t_user",
+			PKColumns: []string{"id"},
+			After:     map[string]interface{}{"id": int64(i), "create_time": time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := spool.Peek(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list[0].After["id"] != int64(0) {
+		t.Fatalf("peek %v", list)
+	}
+	if err = spool.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_ = spool.Close()
+
+	spool, err = OpenSpool(dir, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spool.Len() != 6 {
+		t.Fatalf("len %d", spool.Len())
+	}
+	list, err = spool.Peek(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 6 || list[0].After["id"] != int64(4) {
+		t.Fatalf("peek after reopen %v", list)
+	}
+	if err = spool.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if spool.Len() != 0 || spool.Size() != 0 {
+		t.Fatalf("len %d size %d", spool.Len(), spool.Size())
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1024, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &EventData{Action: "insert", After: map[string]interface{}{"name": "molly"}}
+	for i := 0; i < 100; i++ {
+		if err = spool.Push(data); err != nil {
+			break
+		}
+	}
+	if err != ErrSpoolFull {
+		t.Fatalf("expect ErrSpoolFull, got %v", err)
+	}
+}
+
+type failingConsumer struct {
+	recordConsumer
+	mu sync.Mutex
+	// 返回重试也不会成功的错误
+	permanent bool
+}
+
+func (c *failingConsumer) Accept(data *EventData) error {
+	return c.BatchAccept([]*EventData{data})
+}
+
+func (c *failingConsumer) BatchAccept(list []*EventData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, data := range list {
+		if data.After["id"] == 2 {
+			if c.permanent {
+				return Permanent(errors.New("mapper_parsing_exception"))
+			}
+			return errors.New("sink failed")
+		}
+	}
+	return c.recordConsumer.BatchAccept(list)
+}
+
+func TestSpoolPermanentError(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	spool, err := OpenSpool(filepath.Join(Config.DataDir, "spool", "test"), 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	consumer := &failingConsumer{permanent: true}
+	rule := &EventRule{Name: "test", Spool: spool, Consumer: consumer}
+	for i := 1; i <= 3; i++ {
+		if err = spool.Push(&EventData{Action: "insert", TableName: "test.t_user", After: map[string]interface{}{"id": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// sink 拒绝的事件写入死信文件，后面的事件继续
+	if drainSpool(rule) || spool.Len() != 0 {
+		t.Fatalf("pending %d", spool.Len())
+	}
+	ids := lo.Map(consumer.list, func(item *EventData, index int) interface{} {
+		return item.After["id"]
+	})
+	if !slices.Equal(ids, []interface{}{1, 3}) {
+		t.Fatalf("delivered %v", ids)
+	}
+	if _, err = os.Stat(filepath.Join(Config.DataDir, "deadletter", "test.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPauseBuffer(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	consumer := &failingConsumer{}
+	rule := &EventRule{Name: "test", Stream: make(chan *EventData, 2), Consumer: consumer,
+		stopCh: make(chan struct{}), stopped: make(chan struct{})}
+	rule.Pause()
+	go func() {
+		defer close(rule.stopped)
+		direct(rule)
+	}()
+	// 暂停时管道不会写满
+	pushed := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			rule.Push(&EventData{Action: "insert", TableName: "test.t_user", After: map[string]interface{}{"id": i}})
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("push blocked while paused")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := rule.done.Load(); n != 0 {
+		t.Fatalf("done %d while paused", n)
+	}
+	rule.Resume()
+	for deadline := time.Now().Add(5 * time.Second); rule.done.Load() < 5; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("done %d after resume", rule.done.Load())
+		}
+	}
+	close(rule.stopCh)
+	<-rule.stopped
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	ids := lo.Map(consumer.list, func(item *EventData, index int) interface{} { return item.After["id"] })
+	if !slices.Equal(ids, []interface{}{0, 1, 3, 4}) {
+		t.Errorf("delivered %v", ids)
+	}
+	// 写入失败的事件记录到死信文件
+	if _, err := os.Stat(filepath.Join(Config.DataDir, "deadletter", "test.jsonl")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(Config.DataDir, "spool", "test.paused")); !os.IsNotExist(err) {
+		t.Errorf("pause buffer not removed: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const syncStateFile = "state.json"
+
+// SyncState 同步状态，保存在数据目录，重启之后从这里继续
+type SyncState struct {
+	// 所有规则都已处理完成的 binlog 位置
+	Position MySqlPosition `json:"position"`
+
+	// 从库初始化数据时，从这个 GTID 集合开始同步，收到 binlog 位置之后不再使用
+	GTIDSet string `json:"gtidSet,omitempty"`
+
+	// 已完成初始化数据的规则
+	Snapshots map[string]bool `json:"snapshots"`
+
+	// 正在初始化数据的规则，每张表的进度
+	Progress map[string]map[string]SnapshotProgress `json:"progress,omitempty"`
+}
+
+// pendingPosition 已同步但规则还没处理完成的 binlog 位置
+type pendingPosition struct {
+	pos gomysql.Position
+	// 到达这个位置时，每个规则写入管道的事件数量
+	received map[*EventRule]uint64
+}
+
+var (
+	stateMu          sync.Mutex
+	syncState        = SyncState{Snapshots: map[string]bool{}}
+	stateDirty       bool
+	pendingPositions []pendingPosition
+)
+
+// LoadSyncState 读取数据目录中的同步状态，返回是否存在
+func LoadSyncState() (bool, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	data, err := os.ReadFile(filepath.Join(Config.DataDir, syncStateFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err = json.Unmarshal(data, &syncState); err != nil {
+		return false, err
+	}
+	if syncState.Snapshots == nil {
+		syncState.Snapshots = map[string]bool{}
+	}
+	return len(syncState.Position.File) > 0 || len(syncState.GTIDSet) > 0, nil
+}
+
+// saveSyncState 先写临时文件再重命名，调用之前需要持有 stateMu
+func saveSyncState() error {
+	if err := os.MkdirAll(Config.DataDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(syncState, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(Config.DataDir, syncStateFile)
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	stateDirty = false
+	return nil
+}
+
+// Checkpoint 当前保存的 binlog 位置
+func Checkpoint() gomysql.Position {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return gomysql.Position{Name: syncState.Position.File, Pos: syncState.Position.Position}
+}
+
+// ResetCheckpoint 设置 binlog 位置，丢弃还没处理完成的位置
+func ResetCheckpoint(pos gomysql.Position) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	pendingPositions = nil
+	syncState.Position = MySqlPosition{File: pos.Name, Position: pos.Pos}
+	syncState.GTIDSet = ""
+	if err := saveSyncState(); err != nil {
+		slog.Error("save sync state", slog.Any("err", err))
+	}
+}
+
+// CheckpointGTID 保存的 GTID 集合，只有还没有 binlog 位置时才有值
+func CheckpointGTID() string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return syncState.GTIDSet
+}
+
+// ResetCheckpointGTID 从 GTID 集合开始同步，丢弃还没处理完成的位置
+func ResetCheckpointGTID(gtidSet string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	pendingPositions = nil
+	syncState.Position = MySqlPosition{}
+	syncState.GTIDSet = gtidSet
+	if err := saveSyncState(); err != nil {
+		slog.Error("save sync state", slog.Any("err", err))
+	}
+}
+
+// SnapshotDone 规则是否已完成初始化数据
+func SnapshotDone(ruleName string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return syncState.Snapshots[ruleName]
+}
+
+// MarkSnapshotDone 记录规则已完成初始化数据
+func MarkSnapshotDone(ruleName string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	syncState.Snapshots[ruleName] = true
+	delete(syncState.Progress, ruleName)
+	stateDirty = true
+}
+
+// GetSnapshotProgress 表的初始化数据进度
+func GetSnapshotProgress(ruleName, tableName string) SnapshotProgress {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	progress := syncState.Progress[ruleName][tableName]
+	progress.Chunks = slices.Clone(progress.Chunks)
+	return progress
+}
+
+// HasSnapshotProgress 规则是否有未完成的初始化数据
+func HasSnapshotProgress(ruleName string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return len(syncState.Progress[ruleName]) > 0
+}
+
+// SaveSnapshotProgress 立即保存表的初始化数据进度
+func SaveSnapshotProgress(ruleName, tableName string, progress SnapshotProgress) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if syncState.Progress == nil {
+		syncState.Progress = map[string]map[string]SnapshotProgress{}
+	}
+	if syncState.Progress[ruleName] == nil {
+		syncState.Progress[ruleName] = map[string]SnapshotProgress{}
+	}
+	syncState.Progress[ruleName][tableName] = progress
+	if err := saveSyncState(); err != nil {
+		slog.Error("save sync state", slog.Any("err", err))
+	}
+}
+
+// UpdateSnapshotChunk 立即保存表的一个主键范围的进度，所有范围都完成时表完成
+func UpdateSnapshotChunk(ruleName, tableName string, index int, chunk SnapshotChunk) SnapshotProgress {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	progress := syncState.Progress[ruleName][tableName]
+	progress.Chunks[index] = chunk
+	progress.Done = !slices.ContainsFunc(progress.Chunks, func(item SnapshotChunk) bool {
+		return !item.Done
+	})
+	syncState.Progress[ruleName][tableName] = progress
+	if err := saveSyncState(); err != nil {
+		slog.Error("save sync state", slog.Any("err", err))
+	}
+	progress.Chunks = slices.Clone(progress.Chunks)
+	return progress
+}
+
+// ClearSnapshotProgress 清除表的初始化数据进度，重新初始化时从头开始
+func ClearSnapshotProgress(ruleName string, tableNames []string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, tableName := range tableNames {
+		delete(syncState.Progress[ruleName], tableName)
+	}
+	stateDirty = true
+}
+
+// RecordPosition 记录 binlog 位置，等所有规则处理完之前的事件再保存
+func RecordPosition(pos gomysql.Position) {
+	rules := ActiveRules()
+	received := make(map[*EventRule]uint64, len(rules))
+	for _, rule := range rules {
+		received[rule] = rule.received.Load()
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	// 没有新的事件，只更新位置
+	if n := len(pendingPositions); n > 0 && maps.Equal(pendingPositions[n-1].received, received) {
+		pendingPositions[n-1].pos = pos
+		return
+	}
+	pendingPositions = append(pendingPositions, pendingPosition{pos: pos, received: received})
+}
+
+// flushCheckpoint 保存所有规则都处理完成的最新位置
+func flushCheckpoint() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	rules := ActiveRules()
+	index := -1
+	for i, pending := range pendingPositions {
+		finished := true
+		for rule, received := range pending.received {
+			// 已经移除的规则不再等待
+			if rule.done.Load() < received && slices.Contains(rules, rule) {
+				finished = false
+				break
+			}
+		}
+		if !finished {
+			break
+		}
+		index = i
+	}
+	if index >= 0 {
+		pos := pendingPositions[index].pos
+		syncState.Position = MySqlPosition{File: pos.Name, Position: pos.Pos}
+		syncState.GTIDSet = ""
+		pendingPositions = pendingPositions[index+1:]
+		stateDirty = true
+	}
+	if stateDirty {
+		if err := saveSyncState(); err != nil {
+			slog.Error("save sync state", slog.Any("err", err))
+		}
+	}
+}
+
+// StartCheckpointer 定时保存同步状态
+func StartCheckpointer() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			flushCheckpoint()
+		}
+	}()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TemporalEpochMillis 输出毫秒时间戳，TIME 输出毫秒数
+const TemporalEpochMillis = "epochMillis"
+
+var (
+	// DATETIME、DATE 写入时的时区
+	sourceLocation = time.Local
+	// DATETIME、TIMESTAMP 输出的时区
+	outputLocation = time.Local
+)
+
+// LoadTemporalConfig 解析配置的时区
+func LoadTemporalConfig() error {
+	var err error
+	if sourceLocation, err = time.LoadLocation(Config.Temporal.SourceTimezone); err != nil {
+		return fmt.Errorf("temporal.sourceTimezone: %w", err)
+	}
+	if outputLocation, err = time.LoadLocation(Config.Temporal.OutputTimezone); err != nil {
+		return fmt.Errorf("temporal.outputTimezone: %w", err)
+	}
+	return nil
+}
+
+// TemporalValue 日期、时间字段的值，按字段类型和配置的格式输出
+type TemporalValue struct {
+	// schema.TYPE_DATE、TYPE_DATETIME、TYPE_TIMESTAMP、TYPE_TIME
+	Type int
+	// DATE、DATETIME、TIMESTAMP 的时间
+	Time time.Time
+	// TIME 的时长，可能是负数或者超过 24 小时
+	Duration time.Duration
+}
+
+// newTemporalValue binlog 中是字符串，TIMESTAMP 按 UTC 格式化。
+// 初始化数据的连接使用 UTC，DATETIME、DATE 读取的是 UTC 表示的字面值，TIME 是字符串。
+// 零值日期返回空
+func newTemporalValue(columnType int, value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		if columnType != schema.TYPE_TIMESTAMP {
+			// 字面值按写入时的时区解析
+			v = time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), sourceLocation)
+		}
+		return TemporalValue{Type: columnType, Time: v}
+	case string, []byte:
+		s := ConvertAnyToString(v)
+		if columnType == schema.TYPE_TIME {
+			d, err := parseMySQLDuration(s)
+			if err != nil {
+				return s
+			}
+			return TemporalValue{Type: columnType, Duration: d}
+		}
+		if strings.HasPrefix(s, "0000-00-00") {
+			return nil
+		}
+		location := sourceLocation
+		if columnType == schema.TYPE_TIMESTAMP {
+			location = time.UTC
+		}
+		// 解析时可以包含格式中没有的小数秒
+		layout := time.DateTime
+		if columnType == schema.TYPE_DATE {
+			layout = time.DateOnly
+		}
+		t, err := time.ParseInLocation(layout, s, location)
+		if err != nil {
+			return s
+		}
+		return TemporalValue{Type: columnType, Time: t}
+	}
+	return value
+}
+
+// Layout 字段类型配置的格式
+func (v TemporalValue) Layout() string {
+	switch v.Type {
+	case schema.TYPE_TIME:
+		return Config.Temporal.TimeFormat
+	case schema.TYPE_DATE:
+		return Config.Temporal.DateFormat
+	case schema.TYPE_TIMESTAMP:
+		return Config.Temporal.TimestampFormat
+	}
+	return Config.Temporal.DatetimeFormat
+}
+
+// Format 按配置的格式输出，epochMillis 输出整数
+func (v TemporalValue) Format() interface{} {
+	layout := v.Layout()
+	switch v.Type {
+	case schema.TYPE_TIME:
+		if layout == TemporalEpochMillis {
+			return v.Duration.Milliseconds()
+		}
+		if v.Duration >= 0 && v.Duration < 24*time.Hour {
+			return time.Time{}.Add(v.Duration).Format(layout)
+		}
+		// 超出一天的范围，按 mysql 的格式输出
+		return v.String()
+	case schema.TYPE_DATE:
+		if layout == TemporalEpochMillis {
+			return v.Time.UnixMilli()
+		}
+		return v.Time.Format(layout)
+	}
+	if layout == TemporalEpochMillis {
+		return v.Time.UnixMilli()
+	}
+	return v.Time.In(outputLocation).Format(layout)
+}
+
+// String mysql 格式的字面值，过滤表达式、主键按这个值比较
+func (v TemporalValue) String() string {
+	switch v.Type {
+	case schema.TYPE_TIME:
+		d, sign := v.Duration, ""
+		if d < 0 {
+			d, sign = -d, "-"
+		}
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, int64(d/time.Hour), int64(d/time.Minute%60), int64(d/time.Second%60))
+		if frac := d % time.Second; frac > 0 {
+			s += strings.TrimRight(fmt.Sprintf(".%06d", frac/time.Microsecond), "0")
+		}
+		return s
+	case schema.TYPE_DATE:
+		return v.Time.Format(time.DateOnly)
+	}
+	return v.Time.In(sourceLocation).Format("2006-01-02 15:04:05.999999")
+}
+
+// parseMySQLDuration 解析 [-]HHH:MM:SS[.ffffff]
+func parseMySQLDuration(s string) (time.Duration, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	s, frac, _ := strings.Cut(s, ".")
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	if len(frac) > 0 {
+		n, err := strconv.ParseInt((frac + "000000")[:6], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		d += time.Duration(n) * time.Microsecond
+	}
+	if negative {
+		d = -d
+	}
+	return d, nil
+}